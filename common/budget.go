@@ -0,0 +1,200 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+)
+
+// Budget is the maximum number of queries allowed per statement type and per table.
+// A limit of zero forbids the queries, so statement types left out of a Budget literal
+// are not allowed; set them to Unlimited to leave them unchecked. Tables missing from
+// Tables are not checked.
+type Budget struct {
+	Select int
+	Insert int
+	Update int
+	Delete int
+	// Tables limits the queries referring to each table, keyed by table name
+	Tables map[string]int
+}
+
+// Unlimited is a Budget limit that is not checked. Any negative limit is treated the same.
+const Unlimited = -1
+
+// Statement types queries are counted by
+const (
+	statementSelect = "SELECT"
+	statementInsert = "INSERT"
+	statementUpdate = "UPDATE"
+	statementDelete = "DELETE"
+)
+
+// AssertQueryCount fails the test unless exactly n queries were recorded
+func (qm *QueryManager) AssertQueryCount(t testing.TB, n int) {
+	t.Helper()
+	events := qm.GetEvents()
+	if len(events) == n {
+		return
+	}
+
+	report := qm.newReport()
+	report.printf("\n%s%s=== QUERY COUNT ===%s\n", colorBold, colorCyan, colorReset)
+	report.printf("%sExpected: %d queries | Actual: %d queries%s\n", colorBlue, n, len(events), colorReset)
+	report.queries(events)
+	report.log(t)
+	t.Errorf("expected %d queries, got %d", n, len(events))
+}
+
+// AssertMaxQueries fails the test if more than n queries were recorded
+func (qm *QueryManager) AssertMaxQueries(t testing.TB, n int) {
+	t.Helper()
+	events := qm.GetEvents()
+	if len(events) <= n {
+		return
+	}
+
+	report := qm.newReport()
+	report.printf("\n%s%s=== QUERY COUNT ===%s\n", colorBold, colorCyan, colorReset)
+	report.printf("%sMaximum: %d queries | Actual: %d queries%s\n", colorBlue, n, len(events), colorReset)
+	report.queries(events)
+	report.log(t)
+	t.Errorf("expected at most %d queries, got %d", n, len(events))
+}
+
+// AssertBudget fails the test if the recorded queries exceed the budget,
+// listing the queries of every statement type and table over budget
+func (qm *QueryManager) AssertBudget(t testing.TB, budget Budget) {
+	t.Helper()
+	events := qm.GetEvents()
+
+	byStatement := map[string][]QueryEvent{}
+	byTable := map[string][]QueryEvent{}
+	for _, event := range events {
+		statement, tables := qm.classify(event)
+		byStatement[statement] = append(byStatement[statement], event)
+		for _, table := range tables {
+			byTable[table] = append(byTable[table], event)
+		}
+	}
+
+	type limit struct {
+		name   string
+		max    int
+		events []QueryEvent
+	}
+	var limits []limit
+	for _, l := range []struct {
+		name string
+		max  int
+	}{
+		{statementSelect, budget.Select},
+		{statementInsert, budget.Insert},
+		{statementUpdate, budget.Update},
+		{statementDelete, budget.Delete},
+	} {
+		if l.max >= 0 {
+			limits = append(limits, limit{l.name, l.max, byStatement[l.name]})
+		}
+	}
+	tables := make([]string, 0, len(budget.Tables))
+	for table := range budget.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if n := budget.Tables[table]; n >= 0 {
+			limits = append(limits, limit{"table " + table, n, byTable[strings.ToLower(table)]})
+		}
+	}
+
+	var exceeded []string
+	for _, l := range limits {
+		if len(l.events) > l.max {
+			exceeded = append(exceeded, fmt.Sprintf("%s: %d queries, budget %d", l.name, len(l.events), l.max))
+		}
+	}
+	if len(exceeded) == 0 {
+		return
+	}
+
+	report := qm.newReport()
+	report.printf("\n%s%s=== QUERY BUDGET ===%s\n", colorBold, colorCyan, colorReset)
+	for _, l := range limits {
+		if len(l.events) <= l.max {
+			report.printf("  %s✓ %s:%s %d/%d queries\n", colorGreen, l.name, colorReset, len(l.events), l.max)
+			continue
+		}
+		report.printf("  %s✗ %s:%s %d/%d queries\n", colorRed, l.name, colorReset, len(l.events), l.max)
+		report.queries(l.events)
+	}
+	report.log(t)
+	t.Errorf("query budget exceeded: %s", strings.Join(exceeded, "; "))
+}
+
+// classify returns the statement type of a recorded query and the tables it refers to
+func (qm *QueryManager) classify(event QueryEvent) (string, []string) {
+	query, _ := qm.translate(stripLineComments(event.SQL))
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil || len(stmts) == 0 {
+		return statementOf(query), tableOf(event)
+	}
+
+	statement := ""
+	switch stmts[0].(type) {
+	case *ast.SelectStmt, *ast.SetOprStmt:
+		statement = statementSelect
+	case *ast.InsertStmt:
+		statement = statementInsert
+	case *ast.UpdateStmt:
+		statement = statementUpdate
+	case *ast.DeleteStmt:
+		statement = statementDelete
+	default:
+		statement = statementOf(query)
+	}
+
+	collector := &tableCollector{aliases: map[string]string{}}
+	stmts[0].Accept(collector)
+	tables := uniqueStrings(collector.tables)
+	if len(tables) == 0 {
+		tables = tableOf(event)
+	}
+	return statement, tables
+}
+
+// statementOf returns the first keyword of query, mapping REPLACE to INSERT
+func statementOf(query string) string {
+	fields := strings.Fields(parser.TrimComment(query))
+	if len(fields) == 0 {
+		return ""
+	}
+	statement := strings.ToUpper(fields[0])
+	if statement == "REPLACE" {
+		return statementInsert
+	}
+	return statement
+}
+
+func tableOf(event QueryEvent) []string {
+	if event.Table == "" {
+		return nil
+	}
+	return []string{strings.ToLower(event.Table)}
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
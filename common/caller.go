@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Caller is the Go call site that issued a query
+type Caller struct {
+	File     string
+	Line     int
+	Function string
+}
+
+// String formats the caller as "dir/file.go:line"
+func (c Caller) String() string {
+	if c.File == "" {
+		return ""
+	}
+	file := filepath.Join(filepath.Base(filepath.Dir(c.File)), filepath.Base(c.File))
+	return fmt.Sprintf("%s:%d", filepath.ToSlash(file), c.Line)
+}
+
+// callerSkipPrefixes lists function name prefixes of frames that are never
+// reported as the call site: the Go runtime, GORM itself and gormgolden
+var callerSkipPrefixes = []string{
+	"runtime.",
+	"reflect.",
+	"database/sql.",
+	"gorm.io/",
+	"github.com/jinzhu/gorm",
+	"github.com/po3rin/gormgolden/common.",
+	"github.com/po3rin/gormgolden/gormgoldenv1.",
+	"github.com/po3rin/gormgolden/gormgoldenv2.",
+}
+
+// FindCaller returns the first stack frame outside GORM and gormgolden.
+// It is meant to be called from inside a GORM callback.
+func FindCaller() Caller {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+		if !isSkippedFrame(frame.Function) {
+			return Caller{File: frame.File, Line: frame.Line, Function: frame.Function}
+		}
+		if !more {
+			break
+		}
+	}
+	return Caller{}
+}
+
+func isSkippedFrame(function string) bool {
+	if function == "" {
+		return true
+	}
+	for _, prefix := range callerSkipPrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,555 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/format"
+	"github.com/pingcap/tidb/parser/model"
+	"github.com/pingcap/tidb/parser/opcode"
+)
+
+// canonicalRestoreFlags restores canonical queries with quoted strings and without charset introducers
+const canonicalRestoreFlags = format.RestoreKeyWordUppercase | format.RestoreNameBackQuotes |
+	format.RestoreStringSingleQuotes | format.RestoreStringWithoutCharset
+
+// canonicalize returns a canonical form of query built from its AST, so that semantically
+// equivalent queries produced by GORM v1 and v2 restore to the same text:
+//   - operands of AND/OR chains are flattened, deduplicated and sorted by shape, then text,
+//     keeping the parentheses that operator precedence requires
+//   - redundant parentheses are removed
+//   - adjacent INNER JOINs are sorted by table where their ON clauses allow it
+//   - values of IN lists are deduplicated and sorted, and col IN (x) restores as col=x
+//   - LIMIT offset,count and LIMIT count OFFSET offset restore identically, OFFSET 0 is dropped
+//   - charset introducers (_UTF8MB4'x') are dropped
+//
+// The sorting and OFFSET 0 are skipped for the built-in rules turned off with WithoutRules.
+//
+// ok is false when the query cannot be parsed.
+func (qm *QueryManager) canonicalize(query string) (string, bool) {
+	return qm.canonicalizeWith(query, &canonicalizer{disabled: qm.disabledRules, lossyStrings: qm.Dialect() != DialectMySQL})
+}
+
+// canonicalizeShape returns the canonical form of query with every literal value
+// replaced by a "?" placeholder, so only the shape of queries is compared
+func (qm *QueryManager) canonicalizeShape(query string) (string, bool) {
+	return qm.canonicalizeWith(query, &canonicalizer{shapeOnly: true, disabled: qm.disabledRules})
+}
+
+func (qm *QueryManager) canonicalizeWith(query string, v *canonicalizer) (string, bool) {
+	query = strings.TrimSpace(parser.TrimComment(stripLineComments(query)))
+	if query == "" {
+		return "", false
+	}
+
+	query, returning := qm.translate(query)
+	query = qm.mask(query)
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil || len(stmts) == 0 {
+		return "", false
+	}
+
+	var buf strings.Builder
+	for i, stmt := range stmts {
+		node, _ := stmt.Accept(v)
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		if err := node.Restore(format.NewRestoreCtx(canonicalRestoreFlags, &buf)); err != nil {
+			return "", false
+		}
+	}
+	if returning != "" {
+		buf.WriteString(" " + returning)
+	}
+	return restoreTranslated(buf.String()), true
+}
+
+// comparisonForm returns the form a query is compared in: its canonical AST form,
+// or normalizeForComparison's string form when the query cannot be parsed
+func (qm *QueryManager) comparisonForm(query string) string {
+	if canonical, ok := qm.canonicalize(query); ok {
+		return qm.applyRules(canonical)
+	}
+	return qm.normalizeForComparison(query)
+}
+
+// comparisonShape returns the shape a query is compared in with ShapeOnly
+func (qm *QueryManager) comparisonShape(query string) string {
+	if canonical, ok := qm.canonicalizeShape(query); ok {
+		return qm.applyRules(canonical)
+	}
+	return qm.normalizeForComparison(query)
+}
+
+// canonicalizer is an ast.Visitor rewriting nodes into their canonical form.
+// Nodes are rewritten on Leave, so children are already canonical.
+type canonicalizer struct {
+	// shapeOnly replaces literal values with placeholders
+	shapeOnly bool
+	// disabled holds the built-in rules turned off with WithoutRules
+	disabled map[RuleName]bool
+	// lossyStrings compares identifiers with a charset introducer as strings. Queries of
+	// other dialects than MySQL only have them in golden files written before dialects were
+	// detected, which restored SQLite strings the MySQL way, e.g. `name`=_UTF8MB4Alice.
+	lossyStrings bool
+}
+
+func (c *canonicalizer) Enter(n ast.Node) (ast.Node, bool) {
+	switch node := n.(type) {
+	case *ast.Limit:
+		// Drop OFFSET 0 before its value is masked
+		if isZero(node.Offset) && !c.disabled[RuleLimit] {
+			node.Offset = nil
+		}
+	case *ast.ColumnNameExpr:
+		// MySQL normalization restores strings without quotes, e.g. `name`=_UTF8MB4Alice
+		if node.Name.Table.O == "" && charsetPrefixRegex.MatchString(node.Name.Name.O) {
+			switch {
+			case c.shapeOnly:
+				return ast.NewParamMarkerExpr(0), true
+			case c.lossyStrings:
+				return ast.NewValueExpr(stripCharsetPrefix(node.Name.Name.O), "", ""), true
+			}
+		}
+	}
+	return n, false
+}
+
+func (c *canonicalizer) Leave(n ast.Node) (ast.Node, bool) {
+	switch node := n.(type) {
+	case *ast.ParenthesesExpr:
+		// Parentheses are added back where precedence requires them
+		return node.Expr, true
+	case *ast.BinaryOperationExpr:
+		if (node.Op == opcode.LogicAnd || node.Op == opcode.LogicOr) && !c.disabled[RuleWhereOrder] {
+			return sortLogicOperands(node), true
+		}
+		node.L = parenthesize(node.L, precedence(node), false)
+		node.R = parenthesize(node.R, precedence(node), true)
+	case *ast.UnaryOperationExpr:
+		node.V = parenthesize(node.V, precedence(node), false)
+	case *ast.IsNullExpr:
+		node.Expr = parenthesize(node.Expr, precedence(node), true)
+	case *ast.IsTruthExpr:
+		node.Expr = parenthesize(node.Expr, precedence(node), true)
+	case *ast.PatternInExpr:
+		if node.Sel == nil {
+			if !c.disabled[RuleInListOrder] {
+				node.List = sortInList(node.List)
+			}
+			if len(node.List) == 1 && !isListWildcard(node.List[0]) && !c.disabled[RuleSingleIn] {
+				return singleInAsComparison(node), true
+			}
+		}
+		node.Expr = parenthesize(node.Expr, precedence(node), true)
+	case *ast.PatternLikeOrIlikeExpr:
+		node.Expr = parenthesize(node.Expr, precedence(node), true)
+		node.Pattern = parenthesize(node.Pattern, precedence(node), true)
+	case *ast.BetweenExpr:
+		node.Expr = parenthesize(node.Expr, precedence(node), true)
+		node.Left = parenthesize(node.Left, precedence(node), true)
+		node.Right = parenthesize(node.Right, precedence(node), true)
+	case *ast.ColumnName:
+		node.Name = model.NewCIStr(stripCharsetPrefix(node.Name.O))
+	case ast.ParamMarkerExpr:
+	case ast.ValueExpr:
+		if c.shapeOnly {
+			return ast.NewParamMarkerExpr(0), true
+		}
+	case *ast.TableRefsClause:
+		if !c.disabled[RuleJoinOrder] {
+			node.TableRefs = sortJoins(node.TableRefs)
+		}
+	}
+	return n, true
+}
+
+// sortInList sorts the values of an IN list and drops duplicates, as IN compares them as a set.
+// Placeholders are kept, as each stands for its own arg, and lists with wildcards keep their order.
+func sortInList(list []ast.ExprNode) []ast.ExprNode {
+	type value struct {
+		expr ast.ExprNode
+		key  string
+	}
+	values := make([]value, 0, len(list))
+	seen := make(map[string]bool)
+	for _, expr := range list {
+		key := restoreNode(expr)
+		if strings.Contains(key, "__gormgolden_") {
+			return list
+		}
+		if _, ok := expr.(ast.ParamMarkerExpr); !ok {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		values = append(values, value{expr: expr, key: key})
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].key < values[j].key })
+
+	sorted := make([]ast.ExprNode, len(values))
+	for i, v := range values {
+		sorted[i] = v.expr
+	}
+	return sorted
+}
+
+// isListWildcard reports whether expr is the sentinel of <LIST>, which stays an IN list
+func isListWildcard(expr ast.ExprNode) bool {
+	column, ok := expr.(*ast.ColumnNameExpr)
+	return ok && column.Name.Name.O == "__gormgolden_list__"
+}
+
+// singleInAsComparison rewrites col IN (x) as col=x and col NOT IN (x) as col!=x
+func singleInAsComparison(in *ast.PatternInExpr) ast.ExprNode {
+	op := opcode.EQ
+	if in.Not {
+		op = opcode.NE
+	}
+	comparison := &ast.BinaryOperationExpr{Op: op, L: in.Expr, R: in.List[0]}
+	comparison.L = parenthesize(comparison.L, precedence(comparison), false)
+	comparison.R = parenthesize(comparison.R, precedence(comparison), true)
+	return comparison
+}
+
+// charsetPrefixRegex matches the charset introducer GORM output carries into identifiers
+// once string quotes are lost, e.g. `_UTF8MB4abc`
+var charsetPrefixRegex = regexp.MustCompile(`(?i)^_UTF8MB4(.+)$`)
+
+func stripCharsetPrefix(name string) string {
+	return charsetPrefixRegex.ReplaceAllString(name, "$1")
+}
+
+func isZero(expr ast.ExprNode) bool {
+	value, ok := expr.(ast.ValueExpr)
+	return ok && fmt.Sprint(value.GetValue()) == "0"
+}
+
+// precedence returns the binding strength of an expression; higher binds tighter
+func precedence(expr ast.ExprNode) int {
+	switch e := expr.(type) {
+	case *ast.BinaryOperationExpr:
+		switch e.Op {
+		case opcode.LogicOr:
+			return 1
+		case opcode.LogicXor:
+			return 2
+		case opcode.LogicAnd:
+			return 3
+		case opcode.Or:
+			return 6
+		case opcode.And:
+			return 7
+		case opcode.LeftShift, opcode.RightShift:
+			return 8
+		case opcode.Plus, opcode.Minus:
+			return 9
+		case opcode.Mul, opcode.Div, opcode.Mod, opcode.IntDiv:
+			return 10
+		case opcode.Xor:
+			return 11
+		default:
+			// Comparison operators
+			return 5
+		}
+	case *ast.UnaryOperationExpr:
+		if e.Op == opcode.Not || e.Op == opcode.Not2 {
+			return 4
+		}
+		return 12
+	case *ast.FuncCallExpr:
+		// A set of AND or OR operands binds as its operator, see sortLogicOperands
+		switch e.FnName.L {
+		case logicSetNames[opcode.LogicOr]:
+			return 1
+		case logicSetNames[opcode.LogicAnd]:
+			return 3
+		}
+		return 100
+	case *ast.IsNullExpr, *ast.IsTruthExpr, *ast.PatternInExpr, *ast.PatternLikeOrIlikeExpr,
+		*ast.PatternRegexpExpr, *ast.BetweenExpr, *ast.CompareSubqueryExpr:
+		return 5
+	default:
+		return 100
+	}
+}
+
+// parenthesize wraps an operand in parentheses when it binds looser than its parent.
+// Operands binding equally are wrapped on the right, as operators associate to the left.
+func parenthesize(operand ast.ExprNode, parent int, right bool) ast.ExprNode {
+	if operand == nil {
+		return nil
+	}
+	child := precedence(operand)
+	if child < parent || (child == parent && right && child < 100) {
+		return &ast.ParenthesesExpr{Expr: operand}
+	}
+	return operand
+}
+
+// sortLogicOperands flattens a chain of AND (or OR) operations into a sorted,
+// deduplicated, left-deep chain. Operands are sorted by their shape first, so a wildcard
+// only changes the order among operands of the same shape; those are grouped into an
+// unordered set that keysMatch matches in any order, see logicSetNames.
+func sortLogicOperands(expr *ast.BinaryOperationExpr) ast.ExprNode {
+	var operands []ast.ExprNode
+	var collect func(ast.ExprNode)
+	collect = func(e ast.ExprNode) {
+		if b, ok := e.(*ast.BinaryOperationExpr); ok && b.Op == expr.Op {
+			collect(b.L)
+			collect(b.R)
+			return
+		}
+		operands = append(operands, e)
+	}
+	collect(expr)
+
+	type operand struct {
+		expr  ast.ExprNode
+		key   string
+		shape string
+	}
+	seen := make(map[string]bool, len(operands))
+	sorted := make([]operand, 0, len(operands))
+	for _, e := range operands {
+		e = parenthesize(e, precedence(expr), true)
+		key := restoreNode(e)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sorted = append(sorted, operand{expr: e, key: key, shape: operandValueRegex.ReplaceAllString(key, "?")})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].shape != sorted[j].shape {
+			return sorted[i].shape < sorted[j].shape
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	var result ast.ExprNode
+	add := func(e ast.ExprNode) {
+		if result == nil {
+			result = e
+		} else {
+			result = &ast.BinaryOperationExpr{Op: expr.Op, L: result, R: e}
+		}
+	}
+	for i := 0; i < len(sorted); {
+		end, wildcard := i, false
+		for ; end < len(sorted) && sorted[end].shape == sorted[i].shape; end++ {
+			wildcard = wildcard || strings.Contains(sorted[end].key, "__gormgolden_")
+		}
+		if !wildcard || end-i == 1 {
+			for _, o := range sorted[i:end] {
+				add(o.expr)
+			}
+		} else {
+			set := &ast.FuncCallExpr{FnName: model.NewCIStr(logicSetNames[expr.Op])}
+			for _, o := range sorted[i:end] {
+				set.Args = append(set.Args, o.expr)
+			}
+			add(set)
+		}
+		i = end
+	}
+	return result
+}
+
+// operandValueRegex matches the values of a restored operand: strings, numbers and wildcard sentinels
+var operandValueRegex = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|\b[0-9]+(?:\.[0-9]+)?\b|` + "`__gormgolden_(?:any|list)__`")
+
+// logicSetNames name the function sentinels that hold AND and OR operands of a golden query
+// whose order depends on the values wildcards stand for
+var logicSetNames = map[opcode.Op]string{
+	opcode.LogicAnd: "__gormgolden_and__",
+	opcode.LogicOr:  "__gormgolden_or__",
+}
+
+// sortJoins sorts the runs of adjacent INNER joins of a left-deep chain by table name.
+// A join only moves after the tables its ON clause references, and outer joins, which do not
+// commute, keep their places. Chains containing subqueries, nested joins, USING or NATURAL
+// joins are left untouched.
+func sortJoins(join *ast.Join) *ast.Join {
+	var chain []*ast.Join
+	current := join
+	for current.Right != nil {
+		if _, ok := current.Right.(*ast.TableSource); !ok || len(current.Using) > 0 || current.NaturalJoin || current.StraightJoin {
+			return join
+		}
+		chain = append(chain, current)
+		left, ok := current.Left.(*ast.Join)
+		if !ok {
+			break
+		}
+		current = left
+	}
+	if len(chain) < 2 {
+		return join
+	}
+
+	// The chain was collected from the last join back, put it in query order
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	base := chain[0].Left
+	scope := tableNamesOf(base)
+
+	sorted := make([]*ast.Join, 0, len(chain))
+	for start := 0; start < len(chain); {
+		end := start + 1
+		if isMovableJoin(chain[start]) {
+			for end < len(chain) && isMovableJoin(chain[end]) {
+				end++
+			}
+		}
+		sorted = append(sorted, sortInnerJoins(chain[start:end], scope)...)
+		for _, link := range chain[start:end] {
+			scope[joinAlias(link)] = true
+		}
+		start = end
+	}
+
+	left := base
+	for _, link := range sorted {
+		link.Left = left
+		left = link
+	}
+	return sorted[len(sorted)-1]
+}
+
+// sortInnerJoins orders a run of INNER joins by table name, choosing at each place the first
+// join whose ON clause only references tables in scope, so the order is the same whichever
+// valid order the query used. Runs whose ON clauses reference tables joined later are kept.
+func sortInnerJoins(run []*ast.Join, scope map[string]bool) []*ast.Join {
+	if len(run) < 2 {
+		return run
+	}
+	inScope := make(map[string]bool, len(scope))
+	for name := range scope {
+		inScope[name] = true
+	}
+	// Joins referencing tables not yet joined are kept as written
+	for _, link := range run {
+		if !referencesOnly(link, inScope) {
+			return run
+		}
+		inScope[joinAlias(link)] = true
+	}
+	for _, link := range run {
+		delete(inScope, joinAlias(link))
+	}
+
+	pending := append([]*ast.Join(nil), run...)
+	sort.SliceStable(pending, func(i, j int) bool {
+		return joinTableName(pending[i]) < joinTableName(pending[j])
+	})
+
+	sorted := make([]*ast.Join, 0, len(run))
+	for len(pending) > 0 {
+		// The order as written is valid, so one of the joins can always come next
+		next := 0
+		for i, link := range pending {
+			if referencesOnly(link, inScope) {
+				next = i
+				break
+			}
+		}
+		sorted = append(sorted, pending[next])
+		inScope[joinAlias(pending[next])] = true
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+	return sorted
+}
+
+// isMovableJoin reports whether a join is an INNER join whose ON clause only uses qualified
+// columns, so the tables it depends on are known
+func isMovableJoin(join *ast.Join) bool {
+	if join.Tp != ast.CrossJoin {
+		return false
+	}
+	if join.On == nil {
+		return true
+	}
+	qualified := true
+	join.On.Expr.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if column, ok := n.(*ast.ColumnName); ok && column.Table.L == "" {
+			qualified = false
+		}
+		return n
+	}})
+	return qualified
+}
+
+// referencesOnly reports whether the ON clause of a join only references the tables in scope
+// and the joined table itself
+func referencesOnly(join *ast.Join, scope map[string]bool) bool {
+	if join.On == nil {
+		return true
+	}
+	self := joinAlias(join)
+	ok := true
+	join.On.Expr.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if column, isColumn := n.(*ast.ColumnName); isColumn && column.Table.L != self && !scope[column.Table.L] {
+			ok = false
+		}
+		return n
+	}})
+	return ok
+}
+
+// tableNamesOf returns the names and aliases columns can use to reference the tables of node
+func tableNamesOf(node ast.ResultSetNode) map[string]bool {
+	names := make(map[string]bool)
+	node.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if source, ok := n.(*ast.TableSource); ok {
+			names[tableSourceAlias(source)] = true
+		}
+		return n
+	}})
+	return names
+}
+
+// joinAlias returns the name columns use to reference the table a join adds
+func joinAlias(join *ast.Join) string {
+	source, _ := join.Right.(*ast.TableSource)
+	return tableSourceAlias(source)
+}
+
+func tableSourceAlias(source *ast.TableSource) string {
+	if source == nil {
+		return ""
+	}
+	if source.AsName.L != "" {
+		return source.AsName.L
+	}
+	if table, ok := source.Source.(*ast.TableName); ok {
+		return table.Name.L
+	}
+	return ""
+}
+
+func joinTableName(join *ast.Join) string {
+	if source, ok := join.Right.(*ast.TableSource); ok {
+		if table, ok := source.Source.(*ast.TableName); ok {
+			return table.Name.O
+		}
+		return restoreNode(source)
+	}
+	return ""
+}
+
+// restoreNode restores a node with the canonical restore flags
+func restoreNode(node ast.Node) string {
+	var buf strings.Builder
+	if err := node.Restore(format.NewRestoreCtx(canonicalRestoreFlags, &buf)); err != nil {
+		return ""
+	}
+	return buf.String()
+}
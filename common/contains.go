@@ -0,0 +1,256 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// AssertContainsGolden asserts that the golden file's queries were recorded in order,
+// allowing other queries before, between and after them. This keeps tests stable when
+// unrelated lookups such as feature flags or audit writes are added.
+// When updating, see updatePartialGolden, golden queries no longer recorded are replaced
+// and the others are kept. A missing golden file is created with all recorded queries,
+// to be trimmed by hand down to the ones the test should pin.
+func (qm *QueryManager) AssertContainsGolden(t testing.TB, opts ...AssertOption) {
+	t.Helper()
+	qm.assertPartialGolden(t, "CONTAINS", true, opts)
+}
+
+// AssertSubsetGolden asserts that every query of the golden file was recorded, in any order.
+// Each golden query must be matched by its own recorded query, so duplicates are counted.
+// Golden files are updated as by AssertContainsGolden.
+func (qm *QueryManager) AssertSubsetGolden(t testing.TB, opts ...AssertOption) {
+	t.Helper()
+	qm.assertPartialGolden(t, "SUBSET", false, opts)
+}
+
+func (qm *QueryManager) assertPartialGolden(t testing.TB, title string, ordered bool, opts []AssertOption) {
+	t.Helper()
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	qm.checkRules(t)
+
+	config := newAssertConfig(opts)
+	goldenPath := filepath.Join("testdata", filepath.Base(qm.goldenFile))
+	mode := config.updateMode(t)
+	data, err := os.ReadFile(goldenPath)
+	if os.IsNotExist(err) {
+		if mode != UpdateNone {
+			content, err := qm.renderGoldenFile(qm.events)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			writeGolden(t, goldenPath, content)
+			t.Logf("golden file '%s' holds all recorded queries; remove the ones the test should not pin", goldenPath)
+			return
+		}
+		t.Fatalf(missingGoldenMessage, goldenPath)
+	}
+	if err != nil {
+		t.Fatalf("failed to read golden file '%s': %v", goldenPath, err)
+	}
+
+	actual := make([]string, len(qm.events))
+	for i, event := range qm.events {
+		actual[i] = qm.comparisonKey(qm.entryOf(event), config)
+	}
+	goldenEntries, err := qm.parseGoldenFile(string(data))
+	if err != nil {
+		t.Fatalf("failed to parse golden file '%s': %v", goldenPath, err)
+	}
+	expected := make([]string, len(goldenEntries))
+	for i, entry := range goldenEntries {
+		expected[i] = qm.comparisonKey(entry, config)
+	}
+
+	var matches []int
+	if ordered {
+		matches = matchSubsequence(expected, actual)
+	} else {
+		matches = matchSubset(expected, actual)
+	}
+
+	missing := 0
+	for _, match := range matches {
+		if match == -1 {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return
+	}
+	if mode == UpdateFailed || mode == UpdateAll {
+		writeGolden(t, goldenPath, qm.updatePartialGolden(t, goldenEntries, matches, ordered))
+		return
+	}
+
+	report := qm.newReport()
+	report.printf("\n%s%s=== NORMALIZED COMPARISON (%s) ===%s\n", colorBold, colorCyan, title, colorReset)
+	report.printf("%sExpected: %d queries | Recorded: %d queries%s\n", colorBlue, len(expected), len(actual), colorReset)
+	for i, match := range matches {
+		if match == -1 {
+			report.printf("  %s[%d]%s %s✗ MISSING:%s %s\n", colorBlue, i+1, colorReset, colorRed, colorReset, expected[i])
+		} else {
+			report.printf("  %s[%d]%s %s✓ FOUND at [%d]:%s %s\n", colorBlue, i+1, colorReset, colorGreen, match+1, colorReset, expected[i])
+		}
+	}
+	report.printf("\n  %sRecorded queries:%s\n", colorYellow, colorReset)
+	for i, query := range actual {
+		report.printf("  %s[%d]%s %s\n", colorBlue, i+1, colorReset, query)
+	}
+	report.log(t)
+
+	if ordered {
+		t.Errorf("%d of %d golden queries were not recorded in order (golden file: %s)", missing, len(expected), goldenPath)
+	} else {
+		t.Errorf("%d of %d golden queries were not recorded (golden file: %s)", missing, len(expected), goldenPath)
+	}
+}
+
+// updatePartialGolden returns the golden file with each entry no recorded query matched
+// replaced by an unmatched recorded query of the same shape, or else of the same statement
+// type and tables. For ordered golden files the query must come between the ones matching
+// the neighbouring entries. Entries without such a query are removed, and the matched
+// entries are kept as written, so queries the test does not pin are not added.
+func (qm *QueryManager) updatePartialGolden(t testing.TB, entries []goldenEntry, matches []int, ordered bool) string {
+	t.Helper()
+	used := make([]bool, len(qm.events))
+	for _, match := range matches {
+		if match != -1 {
+			used[match] = true
+		}
+	}
+
+	updated := make([]goldenUpdate, 0, len(entries))
+	next := 0
+	for i := range entries {
+		if matches[i] != -1 {
+			updated = append(updated, goldenUpdate{entry: &entries[i]})
+			next = matches[i] + 1
+			continue
+		}
+
+		start, end := 0, len(qm.events)
+		if ordered {
+			start = next
+			for _, match := range matches[i+1:] {
+				if match != -1 {
+					end = match
+					break
+				}
+			}
+		}
+		j := qm.replacementOf(entries[i], used, start, end)
+		if j == -1 {
+			t.Logf("removed golden query no longer recorded: %s", entries[i].SQL)
+			continue
+		}
+		used[j] = true
+		next = j + 1
+		updated = append(updated, goldenUpdate{event: qm.events[j]})
+	}
+
+	content, err := qm.renderGoldenUpdate(updated)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return content
+}
+
+// replacementOf returns the index of the unused recorded query between start and end
+// that best replaces entry, see updatePartialGolden, or -1
+func (qm *QueryManager) replacementOf(entry goldenEntry, used []bool, start, end int) int {
+	shape := assertConfig{shapeOnly: true}
+	key := qm.comparisonKey(entry, shape)
+	for j := start; j < end; j++ {
+		if !used[j] && keysMatch(key, qm.comparisonKey(qm.entryOf(qm.events[j]), shape)) {
+			return j
+		}
+	}
+
+	statement, tables := qm.classify(QueryEvent{SQL: replaceWildcards(entry.SQL), Table: entry.Table})
+	for j := start; j < end; j++ {
+		if used[j] {
+			continue
+		}
+		s, ts := qm.classify(qm.events[j])
+		if s == statement && strings.Join(ts, ",") == strings.Join(tables, ",") {
+			return j
+		}
+	}
+	return -1
+}
+
+// stepHeaderOf returns the step header above a query of a SQL golden file, if any
+func stepHeaderOf(query string) string {
+	for _, line := range strings.Split(query, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if strings.HasPrefix(line, strings.TrimSpace(stepCommentPrefix)) {
+			return line + "\n"
+		}
+	}
+	return ""
+}
+
+// matchSubsequence matches expected against actual in order and returns, for each
+// expected query, the index of the recorded query matching it, or -1
+func matchSubsequence(expected, actual []string) []int {
+	matches := make([]int, len(expected))
+	next := 0
+	for i, query := range expected {
+		matches[i] = -1
+		for j := next; j < len(actual); j++ {
+			if keysMatch(query, actual[j]) {
+				matches[i] = j
+				next = j + 1
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// matchSubset matches expected against actual in any order, using each recorded query once,
+// and returns for each expected query the index of the recorded query matching it, or -1.
+// It finds a maximum matching by augmenting paths, so a golden query whose wildcards match
+// several recorded queries gives up one that another golden query needs.
+func matchSubset(expected, actual []string) []int {
+	matches := make([]int, len(expected))
+	for i := range matches {
+		matches[i] = -1
+	}
+	// matchedBy[j] is the expected query matched to actual[j], or -1
+	matchedBy := make([]int, len(actual))
+	for j := range matchedBy {
+		matchedBy[j] = -1
+	}
+
+	// augment matches expected[i], moving the queries matched before it to other recorded
+	// queries when that frees one it matches
+	var visited []bool
+	var augment func(i int) bool
+	augment = func(i int) bool {
+		for j := range actual {
+			if visited[j] || !keysMatch(expected[i], actual[j]) {
+				continue
+			}
+			visited[j] = true
+			if matchedBy[j] == -1 || augment(matchedBy[j]) {
+				matches[i] = j
+				matchedBy[j] = i
+				return true
+			}
+		}
+		return false
+	}
+	for i := range expected {
+		visited = make([]bool, len(actual))
+		augment(i)
+	}
+	return matches
+}
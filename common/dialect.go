@@ -0,0 +1,381 @@
+package common
+
+import (
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/format"
+)
+
+// Dialect is the SQL dialect of the recorded queries.
+// Queries are parsed with a MySQL grammar; other dialects are translated into it first.
+type Dialect string
+
+const (
+	DialectMySQL    Dialect = "mysql"
+	DialectPostgres Dialect = "postgres"
+	DialectSQLite   Dialect = "sqlite"
+)
+
+// GORMVersion is the major version of GORM that recorded the queries. The versions quote
+// identifiers and inline strings differently for some dialects.
+type GORMVersion int
+
+const (
+	GORMv1 GORMVersion = 1
+	GORMv2 GORMVersion = 2
+)
+
+// DialectFromName maps a GORM dialector name (db.Dialector.Name()) to a Dialect.
+// Unknown names map to DialectMySQL.
+func DialectFromName(name string) Dialect {
+	switch strings.ToLower(name) {
+	case "postgres", "postgresql", "pgx":
+		return DialectPostgres
+	case "sqlite", "sqlite3":
+		return DialectSQLite
+	default:
+		return DialectMySQL
+	}
+}
+
+// restoreFlags returns the flags normalized queries are restored with.
+// MySQL keeps the charset introducers that existing golden files contain.
+func (d Dialect) restoreFlags() format.RestoreFlags {
+	switch d {
+	case DialectPostgres, DialectSQLite:
+		return format.RestoreKeyWordUppercase | format.RestoreNameBackQuotes |
+			format.RestoreStringSingleQuotes | format.RestoreStringWithoutCharset
+	default:
+		return format.RestoreKeyWordUppercase | format.RestoreNameBackQuotes
+	}
+}
+
+// restoreFlagsFor returns the flags stmt is restored with. Strings MySQL normalization restores
+// without quotes are quoted when they hold a semicolon or a line break, so the query can be
+// split back out of a golden file.
+func (d Dialect) restoreFlagsFor(stmt ast.Node) format.RestoreFlags {
+	flags := d.restoreFlags()
+	if flags&(format.RestoreStringSingleQuotes|format.RestoreStringDoubleQuotes) != 0 {
+		return flags
+	}
+	finder := &separatorStringFinder{}
+	stmt.Accept(finder)
+	if finder.found {
+		flags |= format.RestoreStringSingleQuotes
+	}
+	return flags
+}
+
+// separatorStringFinder finds string values holding a semicolon or a line break
+type separatorStringFinder struct {
+	found bool
+}
+
+func (f *separatorStringFinder) Enter(n ast.Node) (ast.Node, bool) {
+	if value, ok := n.(ast.ValueExpr); ok {
+		if s, ok := value.GetValue().(string); ok && strings.ContainsAny(s, ";\r\n") {
+			f.found = true
+		}
+	}
+	return n, f.found
+}
+
+func (f *separatorStringFinder) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+// translate rewrites dialect-specific syntax into MySQL syntax the parser understands.
+// A trailing RETURNING clause, which the parser does not support, is split off and
+// returned separately so it can be appended to the restored query.
+// PostgreSQL casts and comparisons with ANY, SOME or ALL of an array are translated into
+// function calls restoreTranslated turns back.
+func (d Dialect) translate(query string, version GORMVersion) (string, string) {
+	switch d {
+	case DialectPostgres, DialectSQLite:
+	default:
+		return query, ""
+	}
+
+	// Double quotes delimit identifiers, except in the SQLite queries of GORM v2, which quotes
+	// identifiers with backticks and inlines strings with double quotes
+	identifierQuotes := d == DialectPostgres || version == GORMv1
+
+	var out []byte
+	// The last operand written, which a cast applies to, and the words function calls start with
+	operandStart, operandEnd := -1, -1
+	wordStart, wordEnd := -1, -1
+	var parens []int
+	markOperand := func(start int) {
+		// A qualified name such as "users"."id" or a decimal is one operand
+		if operandEnd != -1 && operandEnd == start-1 && out[start-1] == '.' {
+			start = operandStart
+		}
+		operandStart, operandEnd = start, len(out)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := len(out)
+		switch {
+		case c == '\'' || c == '`':
+			end := quotedEnd(query, i)
+			out = append(out, query[i:end]...)
+			markOperand(start)
+			i = end
+		case c == '"':
+			end := quotedEnd(query, i)
+			content := query[i+1 : end-1]
+			content = strings.ReplaceAll(content, `\"`, `"`)
+			content = strings.ReplaceAll(content, `""`, `"`)
+			if identifierQuotes {
+				out = append(out, "`"+strings.ReplaceAll(content, "`", "``")+"`"...)
+			} else {
+				out = append(out, "'"+strings.ReplaceAll(content, "'", "''")+"'"...)
+			}
+			markOperand(start)
+			i = end
+		case d == DialectPostgres && c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			// $1 placeholders
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+			out = append(out, '?')
+			markOperand(start)
+		case d == DialectPostgres && strings.HasPrefix(query[i:], "::"):
+			// ::type casts
+			end := castEnd(query, i+2)
+			if operandEnd == len(out) && end > i+2 {
+				operand := string(out[operandStart:])
+				out = append(out[:operandStart], castCall(operand, query[i+2:end])...)
+				operandEnd = len(out)
+			} else {
+				// The operand is unknown, so the query is left to fail parsing and be compared as a string
+				out = append(out, query[i:end]...)
+			}
+			i = end
+		case isWordChar(c):
+			end := i
+			for end < len(query) && isWordChar(query[end]) {
+				end++
+			}
+			out = append(out, query[i:end]...)
+			markOperand(start)
+			wordStart, wordEnd = start, len(out)
+			i = end
+		case c == '(':
+			if wordEnd == len(out) {
+				// A function call is one operand with its name
+				start = wordStart
+				if d == DialectPostgres && isArrayComparison(string(out[wordStart:wordEnd]), query[i+1:]) {
+					// ANY, SOME and ALL of an array, which MySQL only allows of a subquery
+					word := strings.ToLower(string(out[wordStart:wordEnd]))
+					out = append(out[:wordStart], arrayComparisonPrefix+word+"__"...)
+				}
+			}
+			parens = append(parens, start)
+			out = append(out, c)
+			i++
+		case c == ')':
+			out = append(out, c)
+			if len(parens) > 0 {
+				operandStart, operandEnd = parens[len(parens)-1], len(out)
+				parens = parens[:len(parens)-1]
+			}
+			i++
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+
+	return splitReturning(string(out))
+}
+
+// restoreTranslated turns the function calls translate wrote back into the PostgreSQL syntax
+func restoreTranslated(query string) string {
+	return restoreArrayComparisons(restoreCasts(query))
+}
+
+// arrayComparisonPrefix starts the function calls ANY, SOME and ALL of an array are translated into
+const arrayComparisonPrefix = "__gormgolden_array_"
+
+// arrayComparisonPattern matches the function calls ANY, SOME and ALL of an array are translated into.
+// Restored queries have the names in upper case.
+var arrayComparisonPattern = regexp.MustCompile(`(?i)__gormgolden_array_(any|some|all)__\(`)
+
+// isArrayComparison reports whether word, followed by a parenthesis and rest, is ANY, SOME
+// or ALL of an array such as ANY($1) rather than of a subquery
+func isArrayComparison(word, rest string) bool {
+	switch strings.ToUpper(word) {
+	case "ANY", "SOME", "ALL":
+	default:
+		return false
+	}
+	fields := strings.Fields(strings.TrimLeft(rest, "( "))
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH", "VALUES", "TABLE":
+		return false
+	}
+	return true
+}
+
+// restoreArrayComparisons turns the function calls translate wrote for ANY, SOME and ALL
+// of an array back into them
+func restoreArrayComparisons(query string) string {
+	return arrayComparisonPattern.ReplaceAllStringFunc(query, func(call string) string {
+		return strings.ToUpper(arrayComparisonPattern.FindStringSubmatch(call)[1]) + "("
+	})
+}
+
+// castPattern matches the function calls casts are translated into, named after the hex-encoded type.
+// Restored queries have the names in upper case.
+var castPattern = regexp.MustCompile(`(?i)__gormgolden_cast_([0-9a-f]+)__\(`)
+
+// castCall returns the function call a cast of operand to typ is translated into
+func castCall(operand, typ string) string {
+	return "__gormgolden_cast_" + hex.EncodeToString([]byte(typ)) + "__(" + operand + ")"
+}
+
+// restoreCasts turns the function calls translate wrote for casts back into casts
+func restoreCasts(query string) string {
+	loc := castPattern.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return query
+	}
+	typ, err := hex.DecodeString(strings.ToLower(query[loc[2]:loc[3]]))
+	end := closingParen(query, loc[1]-1)
+	if err != nil || end == -1 {
+		return query
+	}
+	operand := restoreCasts(query[loc[1]:end])
+	if !isPrimary(operand) {
+		operand = "(" + operand + ")"
+	}
+	return query[:loc[0]] + operand + "::" + string(typ) + restoreCasts(query[end+1:])
+}
+
+// closingParen returns the index of the parenthesis closing the one at open, or -1
+func closingParen(query string, open int) int {
+	depth := 0
+	for i := open; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			i = quotedEnd(query, i) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isPrimary reports whether expr is a single value, name or function call, which a cast
+// applies to without parentheses
+func isPrimary(expr string) bool {
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = quotedEnd(expr, i) - 1
+		case c == '(':
+			end := closingParen(expr, i)
+			if end == -1 {
+				return false
+			}
+			i = end
+		case !isWordChar(c) && c != '.' && c != '?':
+			return false
+		}
+	}
+	return expr != ""
+}
+
+// quotedEnd returns the index just past the quoted token starting at start.
+// Doubled quotes and backslash escapes are part of the token.
+func quotedEnd(query string, start int) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// castEnd returns the index just past the type name of a cast, e.g. "varchar(255)[]"
+func castEnd(query string, i int) int {
+	for i < len(query) && (isDigit(query[i]) || isLetter(query[i]) || query[i] == '_' || query[i] == '.') {
+		i++
+	}
+	if i < len(query) && query[i] == '(' {
+		if end := strings.IndexByte(query[i:], ')'); end != -1 {
+			i += end + 1
+		}
+	}
+	for strings.HasPrefix(query[i:], "[]") {
+		i += 2
+	}
+	return i
+}
+
+// splitReturning splits a top-level RETURNING clause off the end of query
+func splitReturning(query string) (string, string) {
+	depth := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '`' || c == '"':
+			i = quotedEnd(query, i) - 1
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == 'r' || c == 'R') && (i == 0 || !isWordChar(query[i-1])) &&
+			strings.EqualFold(safeSlice(query, i, i+len("RETURNING")), "RETURNING") &&
+			(i+len("RETURNING") == len(query) || !isWordChar(query[i+len("RETURNING")])):
+			columns := strings.Split(strings.TrimSuffix(strings.TrimSpace(query[i+len("RETURNING"):]), ";"), ",")
+			for j, column := range columns {
+				columns[j] = strings.TrimSpace(column)
+			}
+			return strings.TrimSpace(query[:i]), "RETURNING " + strings.Join(columns, ",")
+		}
+	}
+	return query, ""
+}
+
+func safeSlice(s string, start, end int) string {
+	if end > len(s) {
+		return ""
+	}
+	return s[start:end]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isWordChar(c byte) bool {
+	return isDigit(c) || isLetter(c) || c == '_'
+}
@@ -0,0 +1,234 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffOp is the kind of a line in the diff between golden and recorded queries
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	// diffDelete is a golden query that was not recorded
+	diffDelete
+	// diffInsert is a recorded query that is not in the golden file
+	diffInsert
+	// diffChange is a golden query recorded with differences
+	diffChange
+)
+
+// queryDiff is a line in the diff between golden and recorded queries
+type queryDiff struct {
+	op diffOp
+	// expected and actual are the indexes of the golden and the recorded query, or -1
+	expected int
+	actual   int
+}
+
+// diffQueries aligns golden and recorded comparison keys by their longest common subsequence,
+// so an inserted or missing query is reported once instead of shifting every later query.
+// Within a run of differences, similar missing and inserted queries are paired up as changes.
+func diffQueries(expected, actual []string) []queryDiff {
+	// lcs[i][j] is the length of the longest common subsequence of expected[i:] and actual[j:]
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			if keysMatch(expected[i], actual[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diffs, deleted, inserted []queryDiff
+	flush := func() {
+		diffs = append(diffs, pairChanges(deleted, inserted, expected, actual)...)
+		deleted, inserted = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && j < len(actual) && keysMatch(expected[i], actual[j]):
+			flush()
+			diffs = append(diffs, queryDiff{op: diffEqual, expected: i, actual: j})
+			i++
+			j++
+		case j == len(actual) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			deleted = append(deleted, queryDiff{op: diffDelete, expected: i, actual: -1})
+			i++
+		default:
+			inserted = append(inserted, queryDiff{op: diffInsert, expected: -1, actual: j})
+			j++
+		}
+	}
+	flush()
+	return diffs
+}
+
+// minChangeSimilarity is the token similarity above which a missing and an inserted query
+// are shown as one changed query
+const minChangeSimilarity = 0.5
+
+// pairChanges pairs up the missing and inserted queries of a run of differences, in order,
+// with the most similar query, and keeps the others as missing or inserted
+func pairChanges(deleted, inserted []queryDiff, expected, actual []string) []queryDiff {
+	var diffs []queryDiff
+	d, i := 0, 0
+	for _, del := range deleted {
+		best, bestSimilarity := -1, minChangeSimilarity
+		for k := i; k < len(inserted); k++ {
+			if similarity := tokenSimilarity(expected[del.expected], actual[inserted[k].actual]); similarity >= bestSimilarity {
+				if best == -1 || similarity > bestSimilarity {
+					best, bestSimilarity = k, similarity
+				}
+			}
+		}
+		if best == -1 {
+			continue
+		}
+
+		for ; deleted[d].expected < del.expected; d++ {
+			diffs = append(diffs, deleted[d])
+		}
+		diffs = append(diffs, inserted[i:best]...)
+		diffs = append(diffs, queryDiff{op: diffChange, expected: del.expected, actual: inserted[best].actual})
+		d, i = d+1, best+1
+	}
+	diffs = append(diffs, deleted[d:]...)
+	return append(diffs, inserted[i:]...)
+}
+
+// tokenSimilarity returns the share of tokens two queries have in common, from 0 to 1
+func tokenSimilarity(a, b string) float64 {
+	before, after := tokenizeSQL(a), tokenizeSQL(b)
+	if len(before)+len(after) == 0 {
+		return 1
+	}
+	return 2 * float64(tokenLCS(before, after)[0][0]) / float64(len(before)+len(after))
+}
+
+// tokenLCS returns the table of longest common subsequence lengths of before[i:] and after[j:]
+func tokenLCS(before, after []sqlToken) [][]int {
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i].text == after[j].text {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs
+}
+
+// renderQueryDiff renders a query diff in unified style: "-" for missing golden queries,
+// "+" for unexpected recorded ones and "~" for changed ones, with the changed tokens marked
+// as [-removed-]{+added+}. Colored output also highlights the lines and tokens.
+func renderQueryDiff(diffs []queryDiff, expected, actual []string, colored bool) string {
+	paint := func(color, s string) string {
+		if !colored {
+			return s
+		}
+		return color + s + colorReset
+	}
+	position := func(d queryDiff) string {
+		index := func(i int) string {
+			if i < 0 {
+				return " "
+			}
+			return fmt.Sprint(i + 1)
+		}
+		return paint(colorBlue, "["+index(d.expected)+"→"+index(d.actual)+"]")
+	}
+
+	var b strings.Builder
+	for _, d := range diffs {
+		switch d.op {
+		case diffEqual:
+			fmt.Fprintf(&b, "    %s %s\n", position(d), actual[d.actual])
+		case diffDelete:
+			fmt.Fprintf(&b, "  %s %s %s\n", paint(colorRed, "-"), position(d), paint(colorRed, expected[d.expected]))
+		case diffInsert:
+			fmt.Fprintf(&b, "  %s %s %s\n", paint(colorGreen, "+"), position(d), paint(colorGreen, actual[d.actual]))
+		case diffChange:
+			fmt.Fprintf(&b, "  %s %s %s\n", paint(colorYellow, "~"), position(d), diffTokens(expected[d.expected], actual[d.actual], colored))
+		}
+	}
+	return b.String()
+}
+
+// diffTokens renders the recorded query with the tokens that differ from the golden query
+// marked as [-removed-]{+added+}
+func diffTokens(expected, actual string, colored bool) string {
+	before, after := tokenizeSQL(expected), tokenizeSQL(actual)
+	lcs := tokenLCS(before, after)
+
+	var b strings.Builder
+	var removed, added []sqlToken
+	write := func(tokens []sqlToken, open, close, color string) {
+		if len(tokens) == 0 {
+			return
+		}
+		if tokens[0].space && b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		text := open + joinTokens(tokens) + close
+		if colored {
+			text = color + text + colorReset
+		}
+		b.WriteString(text)
+	}
+	flush := func() {
+		write(removed, "[-", "-]", colorRed)
+		write(added, "{+", "+}", colorGreen)
+		removed, added = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && before[i].text == after[j].text:
+			flush()
+			if after[j].space && b.Len() > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(after[j].text)
+			i++
+			j++
+		case j == len(after) || (i < len(before) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, before[i])
+			i++
+		default:
+			added = append(added, after[j])
+			j++
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// joinTokens joins tokens with the spacing they were read with
+func joinTokens(tokens []sqlToken) string {
+	var b strings.Builder
+	for i, token := range tokens {
+		if i > 0 && token.space {
+			b.WriteString(" ")
+		}
+		b.WriteString(token.text)
+	}
+	return b.String()
+}
@@ -0,0 +1,447 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/format"
+	"github.com/pingcap/tidb/parser/model"
+	"github.com/pingcap/tidb/parser/opcode"
+	"github.com/pingcap/tidb/parser/test_driver"
+)
+
+// equivalenceQuery is a query being rewritten by the equivalence rules
+type equivalenceQuery struct {
+	stmt ast.StmtNode
+	// source is the query as recorded or read from the golden file
+	source    string
+	returning string
+	// version is the GORM version that recorded the query
+	version GORMVersion
+}
+
+// equivalenceRule is a difference between the queries of GORM v1 and v2 that
+// AssertEquivalentTo tolerates
+type equivalenceRule struct {
+	name        string
+	description string
+	// apply rewrites the query and reports whether the rule applied to it
+	apply func(q *equivalenceQuery) bool
+}
+
+// equivalenceRules are applied in order to both the GORM v1 golden queries and the recorded ones
+var equivalenceRules = []equivalenceRule{
+	{"introducers", "charset introducers such as _UTF8MB4'x' are dropped", applyIntroducers},
+	{"quoting", "values GORM v1 golden files hold as identifiers or unquoted strings are compared as strings", applyQuoting},
+	{"numbers", "decimals are compared without trailing zeros, e.g. 999.990000 equals 999.99", applyNumbers},
+	{"qualifiers", "columns of single-table queries are compared without their table name", applyQualifiers},
+	{"soft delete", "the deleted_at timestamp set by soft deletes is ignored, unlike restoring it to NULL", applySoftDelete},
+	{"limit", "LIMIT offset,count equals LIMIT count OFFSET offset and OFFSET 0 is dropped", applyLimit},
+	{"returning", "RETURNING clauses added by GORM v2 are ignored", applyReturning},
+	{"parentheses", "redundant parentheses are dropped and conditions compared in any order", applyParentheses},
+}
+
+// equivalence is the form a query is compared in by AssertEquivalentTo, and the rules that applied to it
+type equivalence struct {
+	key     string
+	applied []string
+	// parsed is false when the query could not be parsed and no rule was applied
+	parsed bool
+}
+
+// equivalenceOf rewrites query, recorded by the given GORM version, with the equivalence rules
+func (qm *QueryManager) equivalenceOf(query string, version GORMVersion) equivalence {
+	source := strings.TrimSpace(parser.TrimComment(stripLineComments(unformatSQL(query))))
+	translated, returning := qm.Dialect().translate(source, version)
+	stmts, _, err := parser.New().Parse(qm.mask(translated), "", "")
+	if err != nil || len(stmts) != 1 {
+		return equivalence{key: qm.normalizeForComparison(query)}
+	}
+
+	q := &equivalenceQuery{stmt: stmts[0], source: source, returning: returning, version: version}
+	var applied []string
+	for _, rule := range equivalenceRules {
+		if rule.apply(q) {
+			applied = append(applied, rule.name)
+		}
+	}
+
+	var buf strings.Builder
+	if err := q.stmt.Restore(format.NewRestoreCtx(canonicalRestoreFlags, &buf)); err != nil {
+		return equivalence{key: qm.normalizeForComparison(query)}
+	}
+	if q.returning != "" {
+		buf.WriteString(" " + q.returning)
+	}
+	return equivalence{key: restoreTranslated(buf.String()), applied: applied, parsed: true}
+}
+
+// introducerRegex matches a charset introducer, e.g. _UTF8MB4'x' or the lossy _UTF8MB4x
+var introducerRegex = regexp.MustCompile(`(?i)(^|[^\w])_UTF8MB4`)
+
+func applyIntroducers(q *equivalenceQuery) bool {
+	// Introducers of strings are dropped when restoring, those carried into identifiers here.
+	// An identifier with an introducer is a string whose quotes MySQL normalization lost.
+	v := &nodeRewriter{leave: func(n ast.Node) ast.Node {
+		switch node := n.(type) {
+		case *ast.ColumnNameExpr:
+			if node.Name.Table.O == "" && charsetPrefixRegex.MatchString(node.Name.Name.O) {
+				return ast.NewValueExpr(stripCharsetPrefix(node.Name.Name.O), "", "")
+			}
+		case *ast.ColumnName:
+			if node.Table.O != "" {
+				node.Name = model.NewCIStr(stripCharsetPrefix(node.Name.O))
+			}
+		}
+		return n
+	}}
+	q.stmt.Accept(v)
+	return introducerRegex.MatchString(q.source)
+}
+
+// applyQuoting turns the unqualified identifiers in value positions of GORM v1 queries into strings,
+// as GORM v1 golden files hold strings as identifiers. Identifiers the statement also uses as
+// columns are kept, and queries of later versions, which quote their strings, are left as they are.
+func applyQuoting(q *equivalenceQuery) bool {
+	if q.version != GORMv1 {
+		return false
+	}
+
+	var slots []*ast.ExprNode
+	q.stmt.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		slots = append(slots, valueSlots(n)...)
+		return n
+	}})
+	inSlot := make(map[ast.ExprNode]bool, len(slots))
+	for _, slot := range slots {
+		inSlot[*slot] = true
+	}
+	columns := map[string]bool{}
+	q.stmt.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if column, ok := n.(*ast.ColumnNameExpr); ok && !inSlot[column] {
+			columns[column.Name.Name.L] = true
+		}
+		return n
+	}})
+
+	applied := false
+	for _, slot := range slots {
+		column, ok := (*slot).(*ast.ColumnNameExpr)
+		if !ok || column.Name.Table.O != "" || strings.HasPrefix(column.Name.Name.O, "__gormgolden_") || columns[column.Name.Name.L] {
+			continue
+		}
+		*slot = ast.NewValueExpr(column.Name.Name.O, "", "")
+		applied = true
+	}
+	return applied
+}
+
+// valueSlots returns the operands of n that hold values: the right side of comparisons with a column,
+// IN lists, BETWEEN bounds, LIKE patterns, inserted values and assigned values
+func valueSlots(n ast.Node) []*ast.ExprNode {
+	var slots []*ast.ExprNode
+	switch node := n.(type) {
+	case *ast.BinaryOperationExpr:
+		switch node.Op {
+		case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ:
+			if _, ok := node.L.(*ast.ColumnNameExpr); ok {
+				slots = append(slots, &node.R)
+			}
+		}
+	case *ast.PatternInExpr:
+		for i := range node.List {
+			slots = append(slots, &node.List[i])
+		}
+	case *ast.BetweenExpr:
+		slots = append(slots, &node.Left, &node.Right)
+	case *ast.PatternLikeOrIlikeExpr:
+		slots = append(slots, &node.Pattern)
+	case *ast.InsertStmt:
+		for _, list := range node.Lists {
+			for i := range list {
+				slots = append(slots, &list[i])
+			}
+		}
+	case *ast.Assignment:
+		slots = append(slots, &node.Expr)
+	}
+	return slots
+}
+
+func applyNumbers(q *equivalenceQuery) bool {
+	applied := false
+	v := &nodeRewriter{leave: func(n ast.Node) ast.Node {
+		value, ok := n.(*test_driver.ValueExpr)
+		if !ok || value.Kind() != test_driver.KindMysqlDecimal {
+			return n
+		}
+		decimal := value.GetMysqlDecimal().String()
+		if !strings.Contains(decimal, ".") {
+			return n
+		}
+		trimmed := strings.TrimSuffix(strings.TrimRight(decimal, "0"), ".")
+		if trimmed == decimal {
+			return n
+		}
+		var d test_driver.MyDecimal
+		if err := d.FromString([]byte(trimmed)); err == nil {
+			value.SetMysqlDecimal(&d)
+			applied = true
+		}
+		return n
+	}}
+	q.stmt.Accept(v)
+	return applied
+}
+
+func applyQualifiers(q *equivalenceQuery) bool {
+	collector := &tableCollector{aliases: map[string]string{}}
+	q.stmt.Accept(collector)
+	tables := uniqueStrings(collector.tables)
+	if len(tables) != 1 {
+		return false
+	}
+
+	applied := false
+	v := &nodeRewriter{leave: func(n ast.Node) ast.Node {
+		column, ok := n.(*ast.ColumnName)
+		if !ok || column.Table.L == "" {
+			return n
+		}
+		if column.Table.L == tables[0] || collector.aliases[column.Table.L] == tables[0] {
+			column.Schema = model.CIStr{}
+			column.Table = model.CIStr{}
+			applied = true
+		}
+		return n
+	}}
+	q.stmt.Accept(v)
+	return applied
+}
+
+func applySoftDelete(q *equivalenceQuery) bool {
+	update, ok := q.stmt.(*ast.UpdateStmt)
+	if !ok {
+		return false
+	}
+	applied := false
+	for _, assignment := range update.List {
+		if assignment.Column.Name.L != "deleted_at" {
+			continue
+		}
+		// Only timestamps are masked, so restoring a row to deleted_at=NULL still differs
+		switch value := assignment.Expr.(type) {
+		case *test_driver.ValueExpr:
+			if value.Kind() == test_driver.KindNull {
+				continue
+			}
+		case ast.ParamMarkerExpr:
+		default:
+			continue
+		}
+		assignment.Expr = ast.NewParamMarkerExpr(0)
+		applied = true
+	}
+	return applied
+}
+
+// limitCommaRegex matches the LIMIT offset,count form
+var limitCommaRegex = regexp.MustCompile(`(?i)\bLIMIT\s+[^\s,]+\s*,`)
+
+func applyLimit(q *equivalenceQuery) bool {
+	applied := limitCommaRegex.MatchString(q.source)
+	v := &nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if limit, ok := n.(*ast.Limit); ok && isZero(limit.Offset) {
+			limit.Offset = nil
+			applied = true
+		}
+		return n
+	}}
+	q.stmt.Accept(v)
+	return applied
+}
+
+func applyReturning(q *equivalenceQuery) bool {
+	if q.returning == "" {
+		return false
+	}
+	q.returning = ""
+	return true
+}
+
+func applyParentheses(q *equivalenceQuery) bool {
+	before := countParentheses(q.stmt)
+	q.stmt.Accept(&canonicalizer{})
+	return countParentheses(q.stmt) < before
+}
+
+// countParentheses returns the number of parenthesized expressions in node
+func countParentheses(node ast.Node) int {
+	count := 0
+	node.Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		if _, ok := n.(*ast.ParenthesesExpr); ok {
+			count++
+		}
+		return n
+	}})
+	return count
+}
+
+// nodeRewriter is an ast.Visitor replacing each node with the result of leave
+type nodeRewriter struct {
+	leave func(n ast.Node) ast.Node
+}
+
+func (v *nodeRewriter) Enter(n ast.Node) (ast.Node, bool) {
+	return n, false
+}
+
+func (v *nodeRewriter) Leave(n ast.Node) (ast.Node, bool) {
+	return v.leave(n), true
+}
+
+// AssertEquivalentTo asserts that the recorded queries are equivalent to those of a golden file
+// recorded by gormgoldenv1, to check a migration from GORM v1 to v2. The path is used as is.
+// Queries are compared after the equivalence rules for known differences between GORM v1 and v2
+// (charset introducers, quoting, decimal formatting, table qualifiers, soft deletes, LIMIT forms, RETURNING and
+// parentheses), and each difference is reported with the rules that did and did not apply.
+func (qm *QueryManager) AssertEquivalentTo(t testing.TB, v1GoldenPath string) {
+	t.Helper()
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	qm.checkRules(t)
+
+	data, err := os.ReadFile(v1GoldenPath)
+	if err != nil {
+		t.Fatalf("failed to read GORM v1 golden file '%s': %v", v1GoldenPath, err)
+	}
+	goldenEntries, err := parseGoldenAs(GoldenFormatOf(v1GoldenPath), string(data))
+	if err != nil {
+		t.Fatalf("failed to parse golden file '%s': %v", v1GoldenPath, err)
+	}
+
+	// Golden files recorded with WithParameterized are compared with the queries' placeholders
+	parameterized := false
+	for _, entry := range goldenEntries {
+		parameterized = parameterized || entry.Args != ""
+	}
+
+	expected := make([]equivalence, len(goldenEntries))
+	expectedKeys := make([]string, len(goldenEntries))
+	for i, entry := range goldenEntries {
+		expected[i] = qm.equivalenceOf(replaceWildcards(entry.SQL), GORMv1)
+		expected[i].key = restoreWildcards(expected[i].key)
+		expectedKeys[i] = expected[i].key
+	}
+	actual := make([]equivalence, len(qm.events))
+	actualKeys := make([]string, len(qm.events))
+	for i, event := range qm.events {
+		query := event.SQL
+		if parameterized && event.RawSQL != "" {
+			query = event.RawSQL
+		}
+		actual[i] = qm.equivalenceOf(query, qm.gormVersion)
+		actualKeys[i] = actual[i].key
+	}
+
+	diffs := diffQueries(expectedKeys, actualKeys)
+	different := 0
+	for _, d := range diffs {
+		if d.op != diffEqual {
+			different++
+		}
+	}
+	if different == 0 && !qm.showMatches() {
+		return
+	}
+
+	report := qm.newReport()
+	report.printf("\n%s%s=== EQUIVALENCE (GORM v1 → v2) ===%s\n", colorBold, colorCyan, colorReset)
+	report.printf("%sGORM v1: %d queries | GORM v2: %d queries%s\n", colorBlue, len(expectedKeys), len(actualKeys), colorReset)
+	report.printf("%s", renderQueryDiff(diffs, expectedKeys, actualKeys, report.colored))
+	report.printf("\n  %sRules:%s\n", colorYellow, colorReset)
+	used := map[string]bool{}
+	for i, d := range diffs {
+		var v1, v2 equivalence
+		if d.expected >= 0 {
+			v1 = expected[d.expected]
+		}
+		if d.actual >= 0 {
+			v2 = actual[d.actual]
+		}
+		report.printf("  %s[%d]%s %s\n", colorBlue, i+1, colorReset, explainEquivalence(d, v1, v2))
+		for _, name := range append(v1.applied, v2.applied...) {
+			used[name] = true
+		}
+	}
+	for _, rule := range equivalenceRules {
+		if used[rule.name] {
+			report.printf("      %s: %s\n", rule.name, rule.description)
+		}
+	}
+
+	if different == 0 {
+		report.printf("\n  %s✓ All queries are equivalent to the GORM v1 golden file.%s\n", colorGreen, colorReset)
+		report.log(t)
+		return
+	}
+	report.log(t)
+	t.Errorf("%d of %d queries are not equivalent to the GORM v1 golden file '%s'", different, len(diffs), v1GoldenPath)
+}
+
+// explainEquivalence describes the rules that applied to a pair of aligned queries and,
+// for a difference, those that did not
+func explainEquivalence(d queryDiff, v1, v2 equivalence) string {
+	var applied, notApplied []string
+	for _, rule := range equivalenceRules {
+		var sides []string
+		if d.expected >= 0 && containsString(v1.applied, rule.name) {
+			sides = append(sides, "v1")
+		}
+		if d.actual >= 0 && containsString(v2.applied, rule.name) {
+			sides = append(sides, "v2")
+		}
+		if len(sides) > 0 {
+			applied = append(applied, fmt.Sprintf("%s (%s)", rule.name, strings.Join(sides, ", ")))
+		} else {
+			notApplied = append(notApplied, rule.name)
+		}
+	}
+
+	var b strings.Builder
+	switch d.op {
+	case diffEqual:
+		b.WriteString("equivalent")
+	case diffDelete:
+		b.WriteString("not recorded by GORM v2")
+	case diffInsert:
+		b.WriteString("not in the GORM v1 golden file")
+	case diffChange:
+		b.WriteString("different after the rules")
+	}
+	if (d.expected >= 0 && !v1.parsed) || (d.actual >= 0 && !v2.parsed) {
+		b.WriteString("; could not be parsed, so no rule applied")
+		return b.String()
+	}
+	if len(applied) > 0 {
+		b.WriteString("; applied: " + strings.Join(applied, ", "))
+	}
+	if d.op != diffEqual && len(notApplied) > 0 {
+		b.WriteString("; did not apply: " + strings.Join(notApplied, ", "))
+	}
+	return b.String()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
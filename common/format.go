@@ -0,0 +1,255 @@
+package common
+
+import (
+	"strings"
+)
+
+// indentWidth is the number of spaces clauses are indented by in pretty-printed SQL
+const indentWidth = 2
+
+// clauseKeywords start a new line in pretty-printed SQL, longest first so
+// "LEFT OUTER JOIN" is matched before "LEFT JOIN"
+var clauseKeywords = [][]string{
+	{"ON", "DUPLICATE", "KEY", "UPDATE"},
+	{"LEFT", "OUTER", "JOIN"},
+	{"RIGHT", "OUTER", "JOIN"},
+	{"NATURAL", "LEFT", "JOIN"},
+	{"NATURAL", "RIGHT", "JOIN"},
+	{"GROUP", "BY"},
+	{"ORDER", "BY"},
+	{"LEFT", "JOIN"},
+	{"RIGHT", "JOIN"},
+	{"INNER", "JOIN"},
+	{"CROSS", "JOIN"},
+	{"NATURAL", "JOIN"},
+	{"UNION", "ALL"},
+	{"JOIN"},
+	{"STRAIGHT_JOIN"},
+	{"SELECT"},
+	{"FROM"},
+	{"WHERE"},
+	{"HAVING"},
+	{"LIMIT"},
+	{"SET"},
+	{"VALUES"},
+	{"RETURNING"},
+	{"UNION"},
+}
+
+// commaClauses are the clauses whose comma-separated items go on separate lines
+var commaClauses = map[string]bool{
+	"SELECT":                  true,
+	"SET":                     true,
+	"VALUES":                  true,
+	"GROUP BY":                true,
+	"ORDER BY":                true,
+	"ON DUPLICATE KEY UPDATE": true,
+}
+
+// sqlToken is a word, quoted string or parenthesis of a query
+type sqlToken struct {
+	text string
+	// space reports whether the token was preceded by whitespace
+	space bool
+}
+
+// tokenizeSQL splits a query into tokens. Quoted strings and identifiers are single tokens;
+// parentheses and commas are tokens of their own.
+func tokenizeSQL(query string) []sqlToken {
+	var tokens []sqlToken
+	space := false
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			end := quotedEnd(query, i)
+			tokens = append(tokens, sqlToken{text: query[i:end], space: space})
+			i = end
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, sqlToken{text: query[i : i+1], space: space})
+			i++
+		default:
+			end := i + 1
+			for end < len(query) && !strings.ContainsRune(" \t\r\n'\"`(),", rune(query[end])) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{text: query[i:end], space: space})
+			i = end
+		}
+		space = false
+	}
+	return tokens
+}
+
+// formatFrame is a level of parentheses while pretty-printing
+type formatFrame struct {
+	// statement reports whether the parentheses hold a statement, e.g. a subquery
+	statement bool
+	indent    int
+	// closeIndent is the indent of the line the parentheses were opened on
+	closeIndent int
+	clause      string
+	started     bool
+	between     bool
+}
+
+// formatSQL pretty-prints a normalized query: clauses (SELECT list, FROM, JOINs, WHERE
+// conditions, ORDER BY, ...) and subqueries go on separate, indented lines.
+// unformatSQL turns the result back into the one-line query.
+func formatSQL(query string) string {
+	tokens := tokenizeSQL(query)
+	var b strings.Builder
+	lineIndent := 0
+	newline := func(indent int) {
+		b.WriteString("\n")
+		b.WriteString(strings.Repeat(" ", indent))
+		lineIndent = indent
+	}
+
+	frames := []*formatFrame{{statement: true}}
+	skipSpace := false
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		frame := frames[len(frames)-1]
+		space := token.space && !skipSpace && b.Len() > 0
+		skipSpace = false
+
+		switch {
+		case token.text == "(":
+			if space {
+				b.WriteString(" ")
+			}
+			b.WriteString("(")
+			child := &formatFrame{indent: lineIndent + indentWidth, closeIndent: lineIndent}
+			if i+1 < len(tokens) && tokens[i+1].text == "SELECT" && !tokens[i+1].space && frame.statement {
+				child.statement = true
+				newline(child.indent)
+				skipSpace = true
+			}
+			frames = append(frames, child)
+			continue
+		case token.text == ")":
+			if len(frames) > 1 {
+				frames = frames[:len(frames)-1]
+				if frame.statement {
+					newline(frame.closeIndent)
+				} else if space {
+					b.WriteString(" ")
+				}
+			} else if space {
+				b.WriteString(" ")
+			}
+			b.WriteString(")")
+			continue
+		}
+
+		if !frame.statement {
+			if space {
+				b.WriteString(" ")
+			}
+			b.WriteString(token.text)
+			continue
+		}
+
+		if keyword := clauseAt(tokens, i); keyword != nil && (token.space || !frame.started) && !(token.text == "FROM" && i > 0 && tokens[i-1].text == "DELETE") {
+			if frame.started {
+				newline(frame.indent)
+			}
+			b.WriteString(strings.Join(keyword, " "))
+			frame.clause = strings.Join(keyword, " ")
+			frame.started = true
+			frame.between = false
+			i += len(keyword) - 1
+			continue
+		}
+		frame.started = true
+
+		switch {
+		case token.text == ",":
+			b.WriteString(",")
+			if commaClauses[frame.clause] && i+1 < len(tokens) && !tokens[i+1].space {
+				newline(frame.indent + indentWidth)
+				skipSpace = true
+			}
+		case token.text == "BETWEEN":
+			frame.between = true
+			if space {
+				b.WriteString(" ")
+			}
+			b.WriteString(token.text)
+		case (token.text == "AND" || token.text == "OR") && token.space && (frame.clause == "WHERE" || frame.clause == "HAVING"):
+			if frame.between && token.text == "AND" {
+				frame.between = false
+				b.WriteString(" AND")
+				continue
+			}
+			newline(frame.indent + indentWidth)
+			b.WriteString(token.text)
+		default:
+			if space {
+				b.WriteString(" ")
+			}
+			b.WriteString(token.text)
+		}
+	}
+	return b.String()
+}
+
+// clauseAt returns the clause keyword starting at tokens[i], or nil
+func clauseAt(tokens []sqlToken, i int) []string {
+	for _, keyword := range clauseKeywords {
+		if i+len(keyword) > len(tokens) {
+			continue
+		}
+		matched := true
+		for j, word := range keyword {
+			if tokens[i+j].text != word || (j > 0 && !tokens[i+j].space) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return keyword
+		}
+	}
+	return nil
+}
+
+// unformatSQL joins the lines of a pretty-printed query back into one line. Line breaks
+// after a comma or an opening parenthesis, or before a closing one, are removed; other line
+// breaks become a single space. Line breaks inside quoted strings are kept.
+func unformatSQL(query string) string {
+	if !strings.Contains(query, "\n") {
+		return query
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := quotedEnd(query, i)
+			b.WriteString(query[i:end])
+			i = end
+		case c == '\n' || c == '\r':
+			for i < len(query) && strings.ContainsRune(" \t\r\n", rune(query[i])) {
+				i++
+			}
+			written := b.String()
+			if written == "" || i == len(query) {
+				continue
+			}
+			if last := written[len(written)-1]; last != ',' && last != '(' && last != ' ' && query[i] != ')' {
+				b.WriteString(" ")
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
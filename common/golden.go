@@ -0,0 +1,341 @@
+package common
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/test_driver"
+)
+
+// argsCommentPrefix starts the comment holding the bound values of a parameterized query
+const argsCommentPrefix = "-- args: "
+
+// stepCommentPrefix starts the header above the first query of a step
+const stepCommentPrefix = "-- step: "
+
+// goldenEntry is a single query of a golden file
+type goldenEntry struct {
+	// SQL is the query, including any comment lines above it
+	SQL string
+	// Args is the JSON array of bound values, empty unless recorded with WithParameterized
+	Args string
+	// Step is the step the query was recorded in, set from the last step header
+	Step string
+
+	// Metadata of the query, held only by YAML and JSON golden files
+	Operation    string
+	Table        string
+	RowsAffected *int64
+	Caller       string
+}
+
+// parseGoldenEntries splits golden file content into its queries
+func parseGoldenEntries(content string) []goldenEntry {
+	queries := splitStatements(content)
+	entries := make([]goldenEntry, 0, len(queries))
+	step := ""
+	for _, query := range queries {
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+		entry := goldenEntry{SQL: query}
+		for _, line := range strings.Split(query, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "--") {
+				break
+			}
+			if args, ok := strings.CutPrefix(line, argsCommentPrefix); ok {
+				entry.Args = args
+			}
+			if name, ok := strings.CutPrefix(line, strings.TrimSpace(stepCommentPrefix)); ok {
+				step = strings.TrimSpace(name)
+			}
+		}
+		entry.Step = step
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// splitStatements splits golden file content at the semicolons ending a line or the content.
+// Semicolons in quoted strings and identifiers, comments and dollar-quoted strings do not split,
+// so a query restored by renderGolden is read back exactly.
+func splitStatements(content string) []string {
+	var statements []string
+	start := 0
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = quotedEnd(content, i)
+		case c == '-' && isLineComment(content[i:]):
+			if end := strings.IndexByte(content[i:], '\n'); end != -1 {
+				i += end
+			} else {
+				i = len(content)
+			}
+		case c == '/' && strings.HasPrefix(content[i:], "/*"):
+			if end := strings.Index(content[i+2:], "*/"); end != -1 {
+				i += end + 4
+			} else {
+				i = len(content)
+			}
+		case c == '$':
+			i = dollarQuotedEnd(content, i)
+		case c == ';':
+			rest := content[i+1:]
+			switch {
+			case rest == "":
+				statements = append(statements, content[start:i])
+				start = len(content)
+			case strings.HasPrefix(rest, "\n"), strings.HasPrefix(rest, "\r\n"):
+				statements = append(statements, content[start:i])
+				start = i + 1 + strings.IndexByte(rest, '\n') + 1
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	if start < len(content) {
+		statements = append(statements, content[start:])
+	}
+	return statements
+}
+
+// isLineComment reports whether s starts with a "--" comment, which MySQL requires
+// to be followed by whitespace or the end of the line
+func isLineComment(s string) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	return len(s) == 2 || s[2] == ' ' || s[2] == '\t' || s[2] == '\n' || s[2] == '\r'
+}
+
+// dollarQuotedEnd returns the index just past the PostgreSQL dollar-quoted string starting
+// at start, e.g. $body$ ... $body$, or start+1 if there is none. $1 placeholders are not quotes.
+func dollarQuotedEnd(content string, start int) int {
+	i := start + 1
+	for i < len(content) && (isLetter(content[i]) || content[i] == '_' || (i > start+1 && isDigit(content[i]))) {
+		i++
+	}
+	if i >= len(content) || content[i] != '$' {
+		return start + 1
+	}
+
+	tag := content[start : i+1]
+	end := strings.Index(content[i+1:], tag)
+	if end == -1 {
+		return len(content)
+	}
+	return i + 1 + end + len(tag)
+}
+
+// entryOf returns the golden entry recorded for event
+func (qm *QueryManager) entryOf(event QueryEvent) goldenEntry {
+	rowsAffected := event.RowsAffected
+	entry := goldenEntry{
+		SQL:          event.SQL,
+		Operation:    string(event.Operation),
+		Table:        event.Table,
+		RowsAffected: &rowsAffected,
+		Caller:       event.Caller.String(),
+		Step:         event.Step,
+	}
+	if qm.parameterized && event.RawSQL != "" {
+		entry.SQL = qm.normalize(event.RawSQL)
+		entry.Args = qm.mask(argsJSON(event.Vars))
+	}
+	if qm.prettySQL {
+		entry.SQL = formatSQL(entry.SQL)
+	}
+	return entry
+}
+
+// comparisonKey returns the form a golden entry is compared in, made of the asserted fields.
+// Wildcards in the entry are kept as <ANY> and <LIST>, see keysMatch.
+func (qm *QueryManager) comparisonKey(entry goldenEntry, config assertConfig) string {
+	var parts []string
+	for _, field := range config.asserted() {
+		switch field {
+		case FieldSQL:
+			query := replaceWildcards(entry.SQL)
+			if config.shapeOnly {
+				parts = append(parts, restoreWildcards(qm.comparisonShape(query)))
+			} else {
+				parts = append(parts, restoreWildcards(qm.comparisonForm(query)))
+			}
+		case FieldArgs:
+			if args := normalizeArgs(qm.mask(entry.Args)); !config.shapeOnly && entry.Args != "" && args != "[]" {
+				if !qm.disabledRules[RuleInListOrder] {
+					args = qm.sortInListArgs(entry.SQL, args)
+				}
+				parts = append(parts, argsCommentPrefix+args)
+			}
+		case FieldOperation:
+			parts = append(parts, "-- operation: "+entry.Operation)
+		case FieldTable:
+			parts = append(parts, "-- table: "+entry.Table)
+		case FieldRowsAffected:
+			rowsAffected := "<none>"
+			if entry.RowsAffected != nil {
+				rowsAffected = fmt.Sprint(*entry.RowsAffected)
+			}
+			parts = append(parts, "-- rows_affected: "+rowsAffected)
+		case FieldCaller:
+			parts = append(parts, "-- caller: "+entry.Caller)
+		case FieldStep:
+			if entry.Step != "" {
+				parts = append(parts, stepCommentPrefix+entry.Step)
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// sortInListArgs sorts the args bound to each IN list of placeholders of query, as RuleInListOrder
+// sorts the values of IN lists, so IN (?,?) compares its args as a set too. The placeholders stay,
+// so duplicate args are kept. Lists with a wildcard arg keep their order, so the other args of a
+// golden list with a wildcard are written in the sorted order of the recorded ones.
+func (qm *QueryManager) sortInListArgs(query, args string) string {
+	var values []json.RawMessage
+	if err := json.Unmarshal([]byte(args), &values); err != nil {
+		return args
+	}
+	translated, _ := qm.translate(strings.TrimSpace(parser.TrimComment(stripLineComments(replaceWildcards(query)))))
+	stmts, _, err := parser.New().Parse(translated, "", "")
+	if err != nil || len(stmts) != 1 {
+		return args
+	}
+
+	var markers []*test_driver.ParamMarkerExpr
+	var lists [][]*test_driver.ParamMarkerExpr
+	stmts[0].Accept(&nodeRewriter{leave: func(n ast.Node) ast.Node {
+		switch node := n.(type) {
+		case *test_driver.ParamMarkerExpr:
+			markers = append(markers, node)
+		case *ast.PatternInExpr:
+			var list []*test_driver.ParamMarkerExpr
+			for _, expr := range node.List {
+				if marker, ok := expr.(*test_driver.ParamMarkerExpr); ok {
+					list = append(list, marker)
+				}
+			}
+			if len(list) > 1 && len(list) == len(node.List) {
+				lists = append(lists, list)
+			}
+		}
+		return n
+	}})
+	if len(lists) == 0 || len(markers) != len(values) {
+		return args
+	}
+
+	// Args are bound to the placeholders in the order they appear in the query
+	sort.Slice(markers, func(i, j int) bool { return markers[i].Offset < markers[j].Offset })
+	index := make(map[*test_driver.ParamMarkerExpr]int, len(markers))
+	for i, marker := range markers {
+		index[marker] = i
+	}
+	for _, list := range lists {
+		positions := make([]int, len(list))
+		bound := make([]string, len(list))
+		for i, marker := range list {
+			positions[i] = index[marker]
+			bound[i] = string(values[positions[i]])
+		}
+		if containsString(bound, `"`+AnyWildcard+`"`) {
+			continue
+		}
+		sort.Ints(positions)
+		sort.Strings(bound)
+		for i, position := range positions {
+			values[position] = json.RawMessage(bound[i])
+		}
+	}
+
+	data, err := encodeJSON(values)
+	if err != nil {
+		return args
+	}
+	return data
+}
+
+// argsJSON encodes bound values as a JSON array
+func argsJSON(vars []interface{}) string {
+	args := make([]interface{}, len(vars))
+	for i, v := range vars {
+		args[i] = argValue(v)
+	}
+	data, err := encodeJSON(args)
+	if err != nil {
+		return "[]"
+	}
+	return data
+}
+
+// argValue converts a bound value into a value with a stable JSON encoding
+func argValue(v interface{}) interface{} {
+	if valuer, ok := v.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		v = value
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		return argValue(rv.Elem().Interface())
+	}
+
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	}
+
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// normalizeArgs re-encodes a JSON array of args so formatting differences are ignored
+func normalizeArgs(args string) string {
+	decoder := json.NewDecoder(strings.NewReader(args))
+	decoder.UseNumber()
+	var values []interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return strings.TrimSpace(args)
+	}
+
+	data, err := encodeJSON(values)
+	if err != nil {
+		return strings.TrimSpace(args)
+	}
+	return data
+}
+
+// encodeJSON encodes v on a single line without escaping HTML characters
+func encodeJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GoldenFormat is the file format of a golden file, chosen by its extension
+type GoldenFormat string
+
+const (
+	// GoldenFormatSQL is queries separated by ";\n", used unless the extension says otherwise
+	GoldenFormatSQL GoldenFormat = "sql"
+	// GoldenFormatYAML is a list of queries with their metadata, used for .yaml and .yml files
+	GoldenFormatYAML GoldenFormat = "yaml"
+	// GoldenFormatJSON is an array of queries with their metadata, used for .json files
+	GoldenFormatJSON GoldenFormat = "json"
+)
+
+// GoldenFormatOf returns the format of the golden file at path
+func GoldenFormatOf(path string) GoldenFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return GoldenFormatYAML
+	case ".json":
+		return GoldenFormatJSON
+	default:
+		return GoldenFormatSQL
+	}
+}
+
+// Field is a field of a golden entry
+type Field string
+
+// Fields of a golden entry. Only YAML and JSON golden files hold the operation, table,
+// rows affected and caller of a query.
+const (
+	FieldSQL          Field = "sql"
+	FieldArgs         Field = "args"
+	FieldOperation    Field = "operation"
+	FieldTable        Field = "table"
+	FieldRowsAffected Field = "rows_affected"
+	FieldCaller       Field = "caller"
+	FieldStep         Field = "step"
+)
+
+// allFields lists the fields in the order they appear in comparison keys
+var allFields = []Field{FieldSQL, FieldArgs, FieldOperation, FieldTable, FieldRowsAffected, FieldCaller, FieldStep}
+
+// defaultFields are the fields asserted unless CompareFields is given
+var defaultFields = []Field{FieldSQL, FieldArgs, FieldStep}
+
+// goldenQuery is a query of a YAML or JSON golden file
+type goldenQuery struct {
+	Step         string        `json:"step,omitempty" yaml:"step,omitempty"`
+	SQL          string        `json:"sql" yaml:"sql"`
+	Operation    string        `json:"operation,omitempty" yaml:"operation,omitempty"`
+	Table        string        `json:"table,omitempty" yaml:"table,omitempty"`
+	Args         []interface{} `json:"args,omitempty" yaml:"args,omitempty,flow"`
+	RowsAffected *int64        `json:"rows_affected,omitempty" yaml:"rows_affected,omitempty"`
+	Caller       string        `json:"caller,omitempty" yaml:"caller,omitempty"`
+}
+
+// renderGoldenAs renders events as golden file content in format.
+// YAML and JSON queries hold their caller only with WithCallerComments.
+func (qm *QueryManager) renderGoldenAs(format GoldenFormat, events []QueryEvent) (string, error) {
+	if format == GoldenFormatSQL {
+		return qm.renderGolden(events), nil
+	}
+
+	queries := make([]goldenQuery, len(events))
+	for i, event := range events {
+		queries[i] = qm.goldenQueryOf(event)
+	}
+	return encodeGolden(format, queries)
+}
+
+// goldenQueryOf returns the query of a YAML or JSON golden file recorded for event
+func (qm *QueryManager) goldenQueryOf(event QueryEvent) goldenQuery {
+	query := qm.entryOf(event).query()
+	if !qm.callerComments {
+		query.Caller = ""
+	}
+	return query
+}
+
+// encodeGolden encodes queries as YAML or JSON golden file content
+func encodeGolden(format GoldenFormat, queries []goldenQuery) (string, error) {
+	var buf bytes.Buffer
+	if format == GoldenFormatJSON {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(queries); err != nil {
+			return "", fmt.Errorf("failed to encode golden file: %w", err)
+		}
+		return buf.String(), nil
+	}
+
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(queries); err != nil {
+		return "", fmt.Errorf("failed to encode golden file: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", fmt.Errorf("failed to encode golden file: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// parseGoldenAs splits golden file content in format into its queries
+func parseGoldenAs(format GoldenFormat, content string) ([]goldenEntry, error) {
+	var queries []goldenQuery
+	switch format {
+	case GoldenFormatYAML:
+		if err := yaml.Unmarshal([]byte(content), &queries); err != nil {
+			return nil, err
+		}
+	case GoldenFormatJSON:
+		decoder := json.NewDecoder(strings.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&queries); err != nil {
+			return nil, err
+		}
+	default:
+		return parseGoldenEntries(content), nil
+	}
+
+	entries := make([]goldenEntry, len(queries))
+	for i, query := range queries {
+		entries[i] = query.entry()
+	}
+	return entries, nil
+}
+
+// renderGoldenFile renders events in the format of the manager's golden file
+func (qm *QueryManager) renderGoldenFile(events []QueryEvent) (string, error) {
+	return qm.renderGoldenAs(GoldenFormatOf(qm.goldenFile), events)
+}
+
+// parseGoldenFile parses content in the format of the manager's golden file
+func (qm *QueryManager) parseGoldenFile(content string) ([]goldenEntry, error) {
+	return parseGoldenAs(GoldenFormatOf(qm.goldenFile), content)
+}
+
+// query converts a golden entry into a query of a YAML or JSON golden file
+func (e goldenEntry) query() goldenQuery {
+	q := goldenQuery{
+		Step:         e.Step,
+		SQL:          e.SQL,
+		Operation:    e.Operation,
+		Table:        e.Table,
+		RowsAffected: e.RowsAffected,
+		Caller:       e.Caller,
+	}
+	if e.Args == "" {
+		return q
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(e.Args))
+	decoder.UseNumber()
+	var args []interface{}
+	if err := decoder.Decode(&args); err == nil {
+		q.Args = plainNumbers(args).([]interface{})
+	}
+	return q
+}
+
+// entry converts a query of a YAML or JSON golden file into a golden entry
+func (q goldenQuery) entry() goldenEntry {
+	e := goldenEntry{
+		Step:         q.Step,
+		SQL:          q.SQL,
+		Operation:    q.Operation,
+		Table:        q.Table,
+		RowsAffected: q.RowsAffected,
+		Caller:       q.Caller,
+	}
+	if q.Args != nil {
+		if args, err := encodeJSON(q.Args); err == nil {
+			e.Args = args
+		}
+	}
+	return e
+}
+
+// plainNumbers replaces json.Number values with int64 or float64 so they are encoded as YAML numbers
+func plainNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		if f, err := val.Float64(); err == nil {
+			return f
+		}
+		return val.String()
+	case []interface{}:
+		for i := range val {
+			val[i] = plainNumbers(val[i])
+		}
+		return val
+	case map[string]interface{}:
+		for k := range val {
+			val[k] = plainNumbers(val[k])
+		}
+		return val
+	default:
+		return v
+	}
+}
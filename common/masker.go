@@ -0,0 +1,231 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/tidb/parser"
+	"github.com/pingcap/tidb/parser/ast"
+	"github.com/pingcap/tidb/parser/format"
+	"github.com/pingcap/tidb/parser/opcode"
+)
+
+// Tokens the built-in maskers replace volatile values with
+const (
+	TimestampToken = "<TIMESTAMP>"
+	UUIDToken      = "<UUID>"
+	ULIDToken      = "<ULID>"
+)
+
+// Masker replaces values that change on every run, such as time.Now() or generated IDs,
+// with stable tokens. Maskers are applied to recorded queries and to golden file queries
+// before they are compared. The query is in MySQL syntax, as translated from the Dialect.
+type Masker interface {
+	Mask(query string) string
+}
+
+// MaskerFunc adapts a function to the Masker interface
+type MaskerFunc func(query string) string
+
+// Mask calls f(query)
+func (f MaskerFunc) Mask(query string) string {
+	return f(query)
+}
+
+// valueBoundary matches what may precede a masked value: a non-word character, or the
+// charset introducer MySQL normalization restores strings with (_UTF8MB4<TIMESTAMP>)
+const valueBoundary = `(^|[^0-9A-Za-z_]|_UTF8MB4)`
+
+// RegexpMasker replaces every match of pattern with token.
+// The match must not be preceded by a letter, digit or underscore.
+func RegexpMasker(pattern, token string) Masker {
+	re := regexp.MustCompile(valueBoundary + "(?:" + pattern + `)\b`)
+	replacement := "${1}" + strings.ReplaceAll(token, "$", "$$")
+	return MaskerFunc(func(query string) string {
+		return re.ReplaceAllString(query, replacement)
+	})
+}
+
+// TimestampMasker replaces RFC3339 and SQL datetimes, e.g. 2024-01-02 15:04:05.123, with <TIMESTAMP>
+func TimestampMasker() Masker {
+	return RegexpMasker(`\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?`, TimestampToken)
+}
+
+// UUIDMasker replaces UUIDs with <UUID>
+func UUIDMasker() Masker {
+	return RegexpMasker(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`, UUIDToken)
+}
+
+// ULIDMasker replaces ULIDs with <ULID>
+func ULIDMasker() Masker {
+	return RegexpMasker(`[0-7][0-9A-HJKMNP-TV-Z]{25}`, ULIDToken)
+}
+
+// DefaultMaskers returns the built-in timestamp, UUID and ULID maskers
+func DefaultMaskers() []Masker {
+	return []Masker{TimestampMasker(), UUIDMasker(), ULIDMasker()}
+}
+
+// ColumnMasker replaces the values written to or compared with a column with token,
+// e.g. ColumnMasker("users.created_at", TimestampToken) or ColumnMasker("id", "<ID>").
+// Without a table name the column matches in every table. Values are matched in
+// INSERT value lists, UPDATE assignments, comparisons and IN lists.
+func ColumnMasker(column, token string) Masker {
+	m := &columnMasker{column: column, token: token}
+	if i := strings.LastIndex(column, "."); i != -1 {
+		m.table, m.column = column[:i], column[i+1:]
+	}
+	return m
+}
+
+type columnMasker struct {
+	table  string
+	column string
+	token  string
+}
+
+// Mask parses query and replaces the column's values. Queries that cannot be parsed
+// or do not contain the column are returned unchanged.
+func (m *columnMasker) Mask(query string) string {
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		return query
+	}
+
+	var buf strings.Builder
+	masked := false
+	for i, stmt := range stmts {
+		tables := &tableCollector{aliases: map[string]string{}}
+		stmt.Accept(tables)
+		v := &columnMaskVisitor{masker: m, tables: tables}
+		node, _ := stmt.Accept(v)
+		masked = masked || v.masked
+
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		flags := format.RestoreKeyWordUppercase | format.RestoreNameBackQuotes |
+			format.RestoreStringSingleQuotes | format.RestoreStringWithoutCharset
+		if err := node.Restore(format.NewRestoreCtx(flags, &buf)); err != nil {
+			return query
+		}
+	}
+	if !masked {
+		return query
+	}
+	return buf.String()
+}
+
+// tableCollector collects the tables a statement refers to, and their aliases
+type tableCollector struct {
+	tables  []string
+	aliases map[string]string
+}
+
+func (c *tableCollector) Enter(n ast.Node) (ast.Node, bool) {
+	switch node := n.(type) {
+	case *ast.TableSource:
+		if table, ok := node.Source.(*ast.TableName); ok && node.AsName.O != "" {
+			c.aliases[node.AsName.L] = table.Name.L
+		}
+	case *ast.TableName:
+		c.tables = append(c.tables, node.Name.L)
+	}
+	return n, false
+}
+
+func (c *tableCollector) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+// columnMaskVisitor replaces the values of a columnMasker's column
+type columnMaskVisitor struct {
+	masker *columnMasker
+	tables *tableCollector
+	masked bool
+}
+
+func (v *columnMaskVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	return n, false
+}
+
+func (v *columnMaskVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	switch node := n.(type) {
+	case *ast.InsertStmt:
+		for i, column := range node.Columns {
+			if !v.matches(column) {
+				continue
+			}
+			for _, row := range node.Lists {
+				if i < len(row) {
+					row[i] = v.mask(row[i])
+				}
+			}
+		}
+		for _, assignment := range node.OnDuplicate {
+			if v.matches(assignment.Column) {
+				assignment.Expr = v.mask(assignment.Expr)
+			}
+		}
+	case *ast.UpdateStmt:
+		for _, assignment := range node.List {
+			if v.matches(assignment.Column) {
+				assignment.Expr = v.mask(assignment.Expr)
+			}
+		}
+	case *ast.BinaryOperationExpr:
+		switch node.Op {
+		case opcode.EQ, opcode.NE, opcode.NullEQ, opcode.LT, opcode.LE, opcode.GT, opcode.GE:
+			if column, ok := node.L.(*ast.ColumnNameExpr); ok && v.matches(column.Name) {
+				node.R = v.mask(node.R)
+			}
+			if column, ok := node.R.(*ast.ColumnNameExpr); ok && v.matches(column.Name) {
+				node.L = v.mask(node.L)
+			}
+		}
+	case *ast.PatternInExpr:
+		if column, ok := node.Expr.(*ast.ColumnNameExpr); ok && v.matches(column.Name) {
+			for i, value := range node.List {
+				node.List[i] = v.mask(value)
+			}
+		}
+	}
+	return n, true
+}
+
+// matches reports whether column is the masker's column
+func (v *columnMaskVisitor) matches(column *ast.ColumnName) bool {
+	if column == nil || !strings.EqualFold(column.Name.O, v.masker.column) {
+		return false
+	}
+	if v.masker.table == "" {
+		return true
+	}
+
+	table := strings.ToLower(v.masker.table)
+	if column.Table.O != "" {
+		qualifier := column.Table.L
+		if aliased, ok := v.tables.aliases[qualifier]; ok {
+			qualifier = aliased
+		}
+		return qualifier == table
+	}
+	for _, t := range v.tables.tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// mask replaces a literal value with the masker's token. Placeholders are kept.
+func (v *columnMaskVisitor) mask(expr ast.ExprNode) ast.ExprNode {
+	if _, ok := expr.(ast.ParamMarkerExpr); ok {
+		return expr
+	}
+	if _, ok := expr.(ast.ValueExpr); !ok {
+		return expr
+	}
+	v.masked = true
+	return ast.NewValueExpr(v.masker.token, "", "")
+}
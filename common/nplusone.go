@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// NPlusOne is a query shape repeated more often than allowed within one recording,
+// typically a query issued in a loop instead of a Preload or a JOIN
+type NPlusOne struct {
+	// Shape is the canonical query with literal values replaced by "?"
+	Shape string
+	// Count is how often the shape was recorded
+	Count int
+	// Callers are the call sites that issued the shape, in order of first use
+	Callers []CallerCount
+}
+
+// CallerCount is a call site and how often it issued a query
+type CallerCount struct {
+	Caller string
+	Count  int
+}
+
+// FindNPlusOne groups the recorded SELECTs by shape, ignoring literal values,
+// and returns the shapes recorded more than threshold times, in order of first use.
+// IncludeWrites groups INSERT, UPDATE and DELETE statements too.
+func (qm *QueryManager) FindNPlusOne(threshold int, opts ...AssertOption) []NPlusOne {
+	config := newAssertConfig(opts)
+	qm.mu.Lock()
+	events := make([]QueryEvent, len(qm.events))
+	copy(events, qm.events)
+	qm.mu.Unlock()
+
+	var shapes []string
+	groups := map[string]*NPlusOne{}
+	for _, event := range events {
+		if statement, _ := qm.classify(event); statement != statementSelect && !config.includeWrites {
+			continue
+		}
+		shape := qm.shapeOf(event)
+		group, ok := groups[shape]
+		if !ok {
+			group = &NPlusOne{Shape: shape}
+			groups[shape] = group
+			shapes = append(shapes, shape)
+		}
+		group.Count++
+		group.addCaller(event.Caller.String())
+	}
+
+	var found []NPlusOne
+	for _, shape := range shapes {
+		if group := groups[shape]; group.Count > threshold {
+			found = append(found, *group)
+		}
+	}
+	return found
+}
+
+// AssertNoNPlusOne fails the test if a SELECT shape was recorded more than threshold times,
+// reporting the shape, the count and the call sites that issued it
+func (qm *QueryManager) AssertNoNPlusOne(t testing.TB, threshold int, opts ...AssertOption) {
+	t.Helper()
+	found := qm.FindNPlusOne(threshold, opts...)
+	if len(found) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "N+1 queries detected (threshold %d):", threshold)
+	for _, group := range found {
+		fmt.Fprintf(&b, "\n\n  %dx %s", group.Count, group.Shape)
+		for _, caller := range group.Callers {
+			fmt.Fprintf(&b, "\n     %dx from %s", caller.Count, caller.Caller)
+		}
+	}
+	t.Errorf("%s", b.String())
+}
+
+// shapeOf returns the shape of a recorded query, preferring the query with placeholders
+func (qm *QueryManager) shapeOf(event QueryEvent) string {
+	if event.RawSQL != "" {
+		if shape, ok := qm.canonicalizeShape(event.RawSQL); ok {
+			return shape
+		}
+	}
+	return qm.comparisonShape(event.SQL)
+}
+
+func (n *NPlusOne) addCaller(caller string) {
+	if caller == "" {
+		caller = "<unknown>"
+	}
+	for i := range n.Callers {
+		if n.Callers[i].Caller == caller {
+			n.Callers[i].Count++
+			return
+		}
+	}
+	n.Callers = append(n.Callers, CallerCount{Caller: caller, Count: 1})
+}
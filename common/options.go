@@ -0,0 +1,178 @@
+package common
+
+// Option configures a QueryManager
+type Option func(*QueryManager)
+
+// WithCallerComments makes golden files include a "-- caller: dir/file.go:42"
+// comment above each query, naming the Go call site that issued it.
+// The comments are ignored when queries are compared.
+func WithCallerComments() Option {
+	return func(qm *QueryManager) {
+		qm.callerComments = true
+	}
+}
+
+// WithDialect sets the SQL dialect of the recorded queries, so dialect-specific
+// syntax such as PostgreSQL "$1" placeholders and "::" casts is normalized
+func WithDialect(d Dialect) Option {
+	return func(qm *QueryManager) {
+		qm.SetDialect(d)
+	}
+}
+
+// WithGORMVersion sets the GORM version that recorded the queries, which decides what double
+// quotes delimit in SQLite queries. The plugins set it; it defaults to GORMv2.
+func WithGORMVersion(v GORMVersion) Option {
+	return func(qm *QueryManager) {
+		qm.gormVersion = v
+	}
+}
+
+// WithParameterized records queries with their placeholders instead of inlining the bound values.
+// The values are written to the golden file as an "-- args:" JSON comment above each query,
+// so fixture data changes can be told apart from query changes.
+func WithParameterized() Option {
+	return func(qm *QueryManager) {
+		qm.parameterized = true
+	}
+}
+
+// WithPrettySQL writes golden file queries over several lines, with the SELECT list, FROM,
+// JOINs, WHERE conditions, ORDER BY and subqueries on separate indented lines, so long
+// queries are easier to review. Pretty-printed and one-line queries compare equal.
+func WithPrettySQL() Option {
+	return func(qm *QueryManager) {
+		qm.prettySQL = true
+	}
+}
+
+// WithColor turns ANSI colors in assertion output on or off. By default output is colored
+// unless the NO_COLOR environment variable is set, TERM is "dumb" or stdout is not a terminal,
+// as with go test -json and most CI logs.
+func WithColor(enabled bool) Option {
+	return func(qm *QueryManager) {
+		qm.color = &enabled
+	}
+}
+
+// WithVerbosity sets when assertions log the normalized comparison of matching queries.
+// By default it is only logged when tests run with -v; mismatches are always logged.
+func WithVerbosity(v Verbosity) Option {
+	return func(qm *QueryManager) {
+		qm.verbosity = v
+	}
+}
+
+// WithMaskers replaces volatile values in recorded and golden queries with stable tokens.
+// Use DefaultMaskers for timestamps, UUIDs and ULIDs and ColumnMasker for per-column rules.
+func WithMaskers(maskers ...Masker) Option {
+	return func(qm *QueryManager) {
+		qm.maskers = append(qm.maskers, maskers...)
+	}
+}
+
+// WithRules adds normalization rules, so variations a team considers harmless compare equal.
+// See NormalizationRule and RegexpRule.
+func WithRules(rules ...NormalizationRule) Option {
+	return func(qm *QueryManager) {
+		qm.rules = append(qm.rules, rules...)
+	}
+}
+
+// WithoutRules turns off built-in normalization rules by name: RuleLimit, RuleJoinOrder,
+// RuleWhereOrder, RuleInListOrder or RuleSingleIn, e.g. WithoutRules(RuleWhereOrder) when
+// condition order matters. Golden assertions fail on names that are not built-in rules,
+// so a misspelled name is not silently ignored.
+func WithoutRules(names ...RuleName) Option {
+	return func(qm *QueryManager) {
+		if qm.disabledRules == nil {
+			qm.disabledRules = map[RuleName]bool{}
+		}
+		for _, name := range names {
+			if !isBuiltinRule(name) {
+				qm.unknownRules = append(qm.unknownRules, name)
+				continue
+			}
+			qm.disabledRules[name] = true
+		}
+	}
+}
+
+// AssertOption configures a golden assertion
+type AssertOption func(*assertConfig)
+
+type assertConfig struct {
+	shapeOnly     bool
+	fields        []Field
+	explain       bool
+	includeWrites bool
+	compareOnly   bool
+}
+
+// ShapeOnly compares only the shape of queries: literal values and recorded args are ignored
+// and, when the golden file is updated, kept as written for the queries whose shape matches
+func ShapeOnly() AssertOption {
+	return func(c *assertConfig) {
+		c.shapeOnly = true
+	}
+}
+
+// CompareFields selects the fields of golden entries that are compared, FieldSQL, FieldArgs
+// and FieldStep by default. The operation, table, rows affected and caller are only held by YAML and JSON
+// golden files, e.g. CompareFields(FieldSQL, FieldRowsAffected) with a .golden.yaml file.
+func CompareFields(fields ...Field) AssertOption {
+	return func(c *assertConfig) {
+		c.fields = fields
+	}
+}
+
+// ExplainMismatches makes a failing AssertGolden log, for each changed query, the normalization
+// stages of the golden and the recorded query, so it shows why queries that look identical
+// were not considered equal. See QueryManager.NormalizeTrace.
+func ExplainMismatches() AssertOption {
+	return func(c *assertConfig) {
+		c.explain = true
+	}
+}
+
+// IncludeWrites makes N+1 detection group INSERT, UPDATE and DELETE statements too.
+// By default only SELECTs are grouped, as creating or updating rows in a loop is often intended.
+func IncludeWrites() AssertOption {
+	return func(c *assertConfig) {
+		c.includeWrites = true
+	}
+}
+
+// CompareOnly makes golden assertions compare against golden files without creating or
+// rewriting them, whatever the update mode, e.g. for assertions a test expects to fail
+func CompareOnly() AssertOption {
+	return func(c *assertConfig) {
+		c.compareOnly = true
+	}
+}
+
+func newAssertConfig(opts []AssertOption) assertConfig {
+	var c assertConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// asserted returns the fields to compare, in comparison key order
+func (c assertConfig) asserted() []Field {
+	selected := c.fields
+	if selected == nil {
+		selected = defaultFields
+	}
+	var fields []Field
+	for _, field := range allFields {
+		for _, s := range selected {
+			if s == field {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	return fields
+}
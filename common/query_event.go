@@ -0,0 +1,45 @@
+package common
+
+import (
+	"time"
+)
+
+// Operation identifies the GORM callback chain that recorded a query
+type Operation string
+
+const (
+	OperationCreate Operation = "create"
+	OperationQuery  Operation = "query"
+	OperationUpdate Operation = "update"
+	OperationDelete Operation = "delete"
+	OperationRaw    Operation = "raw"
+	OperationRow    Operation = "row"
+)
+
+// QueryEvent is a single query recorded by a QueryManager
+type QueryEvent struct {
+	// SQL is the normalized query with vars inlined, as written to golden files
+	SQL string
+	// RawSQL is the query as built by GORM, with placeholders
+	RawSQL string
+	// Vars are the values bound to the placeholders in RawSQL
+	Vars []interface{}
+
+	Operation    Operation
+	Table        string
+	Duration     time.Duration
+	RowsAffected int64
+	Error        error
+
+	// Caller is the first stack frame outside GORM and gormgolden that issued the query
+	Caller Caller
+
+	// Step is the name of the step the query was recorded in, see QueryManager.Step
+	Step string
+
+	// Timestamp is the time the query finished
+	Timestamp time.Time
+	// Sequence is the 1-based position of the event in the recording.
+	// It keeps increasing across Clear so events can be correlated between phases.
+	Sequence int
+}
@@ -8,15 +8,16 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pingcap/tidb/parser"
 	"github.com/pingcap/tidb/parser/format"
 	_ "github.com/pingcap/tidb/parser/test_driver"
-	"gotest.tools/v3/golden"
 )
 
-// ANSI color codes for terminal output
+// ANSI color codes for terminal output, removed when colors are disabled
 const (
 	colorRed    = "\033[31m"
 	colorGreen  = "\033[32m"
@@ -27,21 +28,65 @@ const (
 	colorReset  = "\033[0m"
 )
 
+// missingGoldenMessage explains how to create a golden file that does not exist
+const missingGoldenMessage = "Golden file '%s' does not exist.\n\nTo create the golden file:\n1. Run the test with -update flag: go test -update\n   OR\n2. Create only missing golden files: GORMGOLDEN_UPDATE=missing go test\n   OR\n3. Manually create the file with expected SQL queries\n   OR\n4. Use SaveToFile() method to generate the golden file from recorded queries"
+
 // QueryManager manages SQL query recording with thread-safe operations
 type QueryManager struct {
 	mu         sync.Mutex
-	queries    []string
+	events     []QueryEvent
+	sequence   int
 	enabled    bool
 	goldenFile string
+	step       string
+
+	callerComments bool
+	parameterized  bool
+	prettySQL      bool
+	maskers        []Masker
+	rules          []NormalizationRule
+	disabledRules  map[RuleName]bool
+	// unknownRules are the names given to WithoutRules that are not built-in rules
+	unknownRules []RuleName
+	// color forces colored output on or off; nil detects it from the environment
+	color     *bool
+	verbosity Verbosity
+	// gormVersion is the GORM version that recorded the queries, GORMv2 when unset
+	gormVersion GORMVersion
+	// dialect holds the Dialect of recorded queries. It can be set after recording
+	// starts, when a plugin detects it from the database, so it is read atomically.
+	dialect atomic.Value
 }
 
 // NewQueryManager creates a new QueryManager instance
-func NewQueryManager(goldenFile string) *QueryManager {
-	return &QueryManager{
-		queries:    []string{},
+func NewQueryManager(goldenFile string, opts ...Option) *QueryManager {
+	qm := &QueryManager{
+		events:     []QueryEvent{},
 		enabled:    true,
 		goldenFile: goldenFile,
 	}
+	for _, opt := range opts {
+		opt(qm)
+	}
+	return qm
+}
+
+// Dialect returns the SQL dialect queries are normalized for
+func (qm *QueryManager) Dialect() Dialect {
+	if d, ok := qm.dialect.Load().(Dialect); ok {
+		return d
+	}
+	return DialectMySQL
+}
+
+// SetDialect sets the SQL dialect queries are normalized for
+func (qm *QueryManager) SetDialect(d Dialect) {
+	qm.dialect.Store(d)
+}
+
+// translate rewrites the dialect-specific syntax of a recorded query, see Dialect.translate
+func (qm *QueryManager) translate(query string) (string, string) {
+	return qm.Dialect().translate(query, qm.gormVersion)
 }
 
 // normalize normalizes SQL query using TiDB parser
@@ -58,12 +103,19 @@ func (qm *QueryManager) normalize(query string) string {
 		return ""
 	}
 
+	// Translate dialect-specific syntax the MySQL parser does not understand
+	dialect := qm.Dialect()
+	translated, returning := qm.translate(query)
+
+	// Replace volatile values with stable tokens
+	translated = qm.mask(translated)
+
 	// Parse and normalize the SQL
 	p := parser.New()
-	stmts, _, err := p.Parse(query, "", "")
+	stmts, _, err := p.Parse(translated, "", "")
 	if err != nil {
 		// If parsing fails, fall back to basic normalization
-		return qm.basicNormalize(query)
+		return qm.basicNormalize(qm.mask(query))
 	}
 
 	if len(stmts) == 0 {
@@ -76,13 +128,24 @@ func (qm *QueryManager) normalize(query string) string {
 		if i > 0 {
 			buf.WriteString("; ")
 		}
-		if err := stmt.Restore(format.NewRestoreCtx(format.RestoreKeyWordUppercase|format.RestoreNameBackQuotes, &buf)); err != nil {
+		if err := stmt.Restore(format.NewRestoreCtx(dialect.restoreFlagsFor(stmt), &buf)); err != nil {
 			// If restore fails, fall back to basic normalization
-			return qm.basicNormalize(query)
+			return qm.basicNormalize(qm.mask(query))
 		}
 	}
+	if returning != "" {
+		buf.WriteString(" " + returning)
+	}
 
-	return buf.String()
+	return restoreTranslated(buf.String())
+}
+
+// mask applies the maskers to query in order
+func (qm *QueryManager) mask(query string) string {
+	for _, masker := range qm.maskers {
+		query = masker.Mask(query)
+	}
+	return query
 }
 
 // basicNormalize provides basic SQL normalization as fallback
@@ -106,34 +169,63 @@ func (qm *QueryManager) basicNormalize(query string) string {
 
 // normalizeForComparison normalizes SQL for comparison by removing charset prefixes and all parentheses
 func (qm *QueryManager) normalizeForComparison(query string) string {
-	// Start with basic normalization
-	query = qm.basicNormalize(query)
-
-	// Remove backticks for comparison (do this early to simplify parsing)
-	query = strings.ReplaceAll(query, "`", "")
-
-	// Remove MySQL charset prefixes like _UTF8MB4
-	utf8mb4Regex := regexp.MustCompile(`_UTF8MB4([0-9A-Za-z]+)`)
-	query = utf8mb4Regex.ReplaceAllString(query, "$1")
+	for _, stage := range qm.normalizeStages() {
+		query = stage.apply(query)
+	}
+	return query
+}
 
-	// Normalize LIMIT clause format:
-	// Convert "LIMIT offset,count" to "LIMIT count OFFSET offset" format
-	// Remove OFFSET 0 as it's redundant (e.g., "LIMIT 100 OFFSET 0" -> "LIMIT 100")
-	query = qm.normalizeLimitClause(query)
+// normalizeStage is a named step of normalizeForComparison
+type normalizeStage struct {
+	name  string
+	apply func(query string) string
+}
 
-	// Normalize JOIN order BEFORE WHERE clause normalization
-	// GORM v1 and v2 may produce JOINs in different order, but semantically identical
-	query = qm.normalizeJoinOrder(query)
+// normalizeStages returns the steps of normalizeForComparison, in order
+func (qm *QueryManager) normalizeStages() []normalizeStage {
+	stages := []normalizeStage{
+		// Drop "-- caller:" style comment lines written above golden queries
+		// and join pretty-printed queries back into one line
+		{"comments", func(query string) string { return unformatSQL(stripLineComments(query)) }},
+		{"mask", qm.mask},
+		{"basicNormalize", qm.basicNormalize},
+		// Remove backticks for comparison (do this early to simplify parsing)
+		{"backticks", func(query string) string { return strings.ReplaceAll(query, "`", "") }},
+		// Remove MySQL charset prefixes like _UTF8MB4
+		{"charset", func(query string) string { return utf8mb4Regex.ReplaceAllString(query, "$1") }},
+	}
 
-	// Normalize main WHERE clause BEFORE removing parentheses
-	// This allows us to identify the main WHERE vs subquery WHERE correctly
-	query = qm.normalizeMainWhereClause(query)
+	// Normalization rules, by default: LIMIT clause format, JOIN order BEFORE WHERE clause
+	// normalization, and main WHERE clause BEFORE removing parentheses, which allows us to
+	// identify the main WHERE vs subquery WHERE correctly
+	for _, rule := range qm.normalizationRules() {
+		stages = append(stages, normalizeStage{rule.Name(), rule.Normalize})
+	}
 
 	// Remove ALL parentheses for comparison (after WHERE normalization)
-	query = strings.ReplaceAll(query, "(", "")
-	query = strings.ReplaceAll(query, ")", "")
+	return append(stages, normalizeStage{"parentheses", func(query string) string {
+		query = strings.ReplaceAll(query, "(", "")
+		return strings.ReplaceAll(query, ")", "")
+	}})
+}
 
-	return query
+// utf8mb4Regex matches a MySQL charset prefix and the value it is attached to
+var utf8mb4Regex = regexp.MustCompile(`_UTF8MB4([0-9A-Za-z]+)`)
+
+// stripLineComments removes lines that consist only of a "--" comment
+func stripLineComments(query string) string {
+	if !strings.Contains(query, "--") {
+		return query
+	}
+	lines := strings.Split(query, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
 }
 
 // normalizeLimitClause normalizes LIMIT clause format for comparison
@@ -662,16 +754,55 @@ func (qm *QueryManager) normalizeWhereClause(query string) string {
 
 // AddQuery adds a SQL query to the recorded list
 func (qm *QueryManager) AddQuery(query string) {
-	if !qm.enabled || query == "" {
+	qm.AddEvent(QueryEvent{SQL: query})
+}
+
+// AddEvent records a query event. The SQL is normalized before it is stored,
+// and Sequence (and Timestamp, when unset) are filled in by the manager.
+func (qm *QueryManager) AddEvent(event QueryEvent) {
+	if !qm.Enabled() || event.SQL == "" {
 		return
 	}
 
 	// Normalize the query before adding
-	normalizedQuery := qm.normalize(query)
+	event.SQL = qm.normalize(event.SQL)
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	qm.sequence++
+	event.Sequence = qm.sequence
+	if event.Step == "" {
+		event.Step = qm.step
+	}
+	qm.events = append(qm.events, event)
+}
+
+// Step starts a named section of the recording: the queries recorded after it belong to the
+// step until the next call. Golden files start each step with a "-- step: name" header, so
+// one golden file can document a whole scenario instead of calling Clear between phases.
+func (qm *QueryManager) Step(name string) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	qm.step = name
+}
 
+// Enabled reports whether query recording is enabled
+func (qm *QueryManager) Enabled() bool {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
-	qm.queries = append(qm.queries, normalizedQuery)
+	return qm.enabled
+}
+
+// queriesLocked projects the SQL of recorded events. qm.mu must be held.
+func (qm *QueryManager) queriesLocked() []string {
+	queries := make([]string, len(qm.events))
+	for i, event := range qm.events {
+		queries[i] = event.SQL
+	}
+	return queries
 }
 
 // Enable enables query recording
@@ -688,23 +819,32 @@ func (qm *QueryManager) Disable() {
 	qm.enabled = false
 }
 
-// Clear clears all recorded queries
+// Clear clears all recorded queries and ends the current step
 func (qm *QueryManager) Clear() {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
-	qm.queries = []string{}
+	qm.events = []QueryEvent{}
+	qm.step = ""
 }
 
 // GetQueries returns a copy of all recorded queries
 func (qm *QueryManager) GetQueries() []string {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
-	result := make([]string, len(qm.queries))
-	copy(result, qm.queries)
+	return qm.queriesLocked()
+}
+
+// GetEvents returns a copy of all recorded query events
+func (qm *QueryManager) GetEvents() []QueryEvent {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	result := make([]QueryEvent, len(qm.events))
+	copy(result, qm.events)
 	return result
 }
 
-// SaveToFile saves all recorded queries to a file with semicolon separators
+// SaveToFile saves all recorded queries to a file with semicolon separators,
+// or as YAML or JSON with their metadata when filePath ends in .yaml, .yml or .json
 func (qm *QueryManager) SaveToFile(filePath string) error {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
@@ -717,166 +857,233 @@ func (qm *QueryManager) SaveToFile(filePath string) error {
 		}
 	}
 
-	content := strings.Join(qm.queries, ";\n")
-	if len(qm.queries) > 0 && content != "" {
+	content, err := qm.renderGoldenAs(GoldenFormatOf(filePath), qm.events)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, []byte(content), 0644)
+}
+
+// renderGolden renders events in the SQL golden file format: queries separated by ";\n",
+// optionally preceded by caller and args comments. The first query of each step is
+// preceded by the step header.
+func (qm *QueryManager) renderGolden(events []QueryEvent) string {
+	entries := make([]string, 0, len(events))
+	step := ""
+	for _, event := range events {
+		entry := qm.renderQuery(event)
+		if event.Step != step {
+			entry = stepCommentPrefix + event.Step + "\n" + entry
+			step = event.Step
+		}
+		entries = append(entries, entry)
+	}
+
+	content := strings.Join(entries, ";\n")
+	if len(entries) > 0 && content != "" {
 		content += ";"
 	}
+	return content
+}
 
-	return os.WriteFile(filePath, []byte(content), 0644)
+// renderQuery renders event as a query of a SQL golden file, without the step header
+func (qm *QueryManager) renderQuery(event QueryEvent) string {
+	golden := qm.entryOf(event)
+	query := golden.SQL
+	if golden.Args != "" {
+		query = argsCommentPrefix + golden.Args + "\n" + query
+	}
+	if qm.callerComments && event.Caller.File != "" {
+		query = "-- caller: " + event.Caller.String() + "\n" + query
+	}
+	return query
 }
 
-// AssertGolden asserts the recorded queries against a golden file
-func (qm *QueryManager) AssertGolden(t *testing.T) {
+// AssertGolden asserts the recorded queries against a golden file.
+// Queries recorded with WithParameterized are compared with their args unless ShapeOnly is given.
+func (qm *QueryManager) AssertGolden(t testing.TB, opts ...AssertOption) {
+	t.Helper()
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
+	qm.checkRules(t)
 
-	content := strings.Join(qm.queries, ";\n")
-	if len(qm.queries) > 0 && content != "" {
-		content += ";"
+	config := newAssertConfig(opts)
+	recorded := make([]goldenEntry, len(qm.events))
+	for i, event := range qm.events {
+		recorded[i] = qm.entryOf(event)
+	}
+	content, err := qm.renderGoldenFile(qm.events)
+	if err != nil {
+		t.Fatalf("%v", err)
 	}
 
 	// Use only the filename part for golden.Assert since it automatically looks in testdata/
 	filename := filepath.Base(qm.goldenFile)
 
-	// Check if golden file exists and provide helpful error message (only when not updating)
-	if !golden.FlagUpdate() {
-		goldenPath := filepath.Join("testdata", filename)
-		if _, err := os.Stat(goldenPath); os.IsNotExist(err) {
-			t.Fatalf("Golden file '%s' does not exist.\n\nTo create the golden file:\n1. Run the test with -update flag: go test -update\n   OR\n2. Manually create the file with expected SQL queries\n   OR\n3. Use SaveToFile() method to generate the golden file from recorded queries", goldenPath)
+	goldenPath := filepath.Join("testdata", filename)
+	mode := config.updateMode(t)
+
+	// Create a missing golden file when updating, otherwise explain how to create it
+	if _, err := os.Stat(goldenPath); os.IsNotExist(err) {
+		if mode != UpdateNone {
+			writeGolden(t, goldenPath, content)
+			return
 		}
+		t.Fatalf(missingGoldenMessage, goldenPath)
+	}
 
-		// Perform normalized comparison before golden assertion
-		if data, err := os.ReadFile(goldenPath); err == nil {
-			goldenContent := string(data)
+	// Perform normalized comparison before golden assertion
+	if data, err := os.ReadFile(goldenPath); err == nil {
+		goldenContent := string(data)
 
-			// Normalize actual queries for comparison
-			actualNormalized := make([]string, len(qm.queries))
-			for i, query := range qm.queries {
-				actualNormalized[i] = qm.normalizeForComparison(query)
-			}
+		// Normalize actual queries for comparison
+		actualNormalized := make([]string, len(recorded))
+		for i, entry := range recorded {
+			actualNormalized[i] = qm.comparisonKey(entry, config)
+		}
+
+		// Normalize golden queries for comparison
+		goldenEntries, err := qm.parseGoldenFile(goldenContent)
+		if err != nil {
+			t.Fatalf("failed to parse golden file '%s': %v", goldenPath, err)
+		}
+		goldenNormalized := make([]string, len(goldenEntries))
+		for i, entry := range goldenEntries {
+			goldenNormalized[i] = qm.comparisonKey(entry, config)
+		}
 
-			// Normalize golden queries for comparison
-			queries := strings.Split(strings.TrimSuffix(goldenContent, ";"), ";\n")
-			goldenNormalized := make([]string, 0, len(queries))
-			for _, query := range queries {
-				if strings.TrimSpace(query) != "" {
-					goldenNormalized = append(goldenNormalized, qm.normalizeForComparison(query))
+		// Check if normalized queries match
+		if len(actualNormalized) == len(goldenNormalized) {
+			allMatch := true
+			for i := 0; i < len(actualNormalized); i++ {
+				if !keysMatch(goldenNormalized[i], actualNormalized[i]) {
+					allMatch = false
+					break
 				}
 			}
 
-			// Check if normalized queries match
-			if len(actualNormalized) == len(goldenNormalized) {
-				allMatch := true
-				for i := 0; i < len(actualNormalized); i++ {
-					if actualNormalized[i] != goldenNormalized[i] {
-						allMatch = false
-						break
+			if allMatch {
+				// Show normalized comparison for success case when asked to
+				if qm.showMatches() {
+					report := qm.newReport()
+					report.printf("\n%s%s=== NORMALIZED COMPARISON ===%s\n", colorBold, colorCyan, colorReset)
+					report.printf("%sTotal queries: %d%s\n", colorBlue, len(actualNormalized), colorReset)
+					for i := 0; i < len(actualNormalized); i++ {
+						report.printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, actualNormalized[i])
 					}
+					report.printf("\n  %s✓ All normalized queries match! The difference is only in formatting.%s\n", colorGreen, colorReset)
+					report.log(t)
 				}
+				// Return early - test passes
+				return
+			}
+		}
 
-				if allMatch {
-					// Show normalized comparison for success case
-					fmt.Printf("\n%s%s=== NORMALIZED COMPARISON ===%s\n", colorBold, colorCyan, colorReset)
-					fmt.Printf("%sTotal queries: %d%s\n", colorBlue, len(actualNormalized), colorReset)
-					for i := 0; i < len(actualNormalized); i++ {
-						fmt.Printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, actualNormalized[i])
-					}
-					fmt.Printf("\n  %s✓ All normalized queries match! The difference is only in formatting.%s\n", colorGreen, colorReset)
-					// Return early - test passes
-					return
+		// The recorded queries do not match the golden file: rewrite the queries that differ,
+		// keeping the matching ones as written so their formatting and wildcards survive
+		if mode == UpdateFailed || mode == UpdateAll {
+			var updated []goldenUpdate
+			for _, d := range diffQueries(goldenNormalized, actualNormalized) {
+				switch d.op {
+				case diffEqual:
+					updated = append(updated, goldenUpdate{entry: &goldenEntries[d.expected]})
+				case diffChange, diffInsert:
+					updated = append(updated, goldenUpdate{event: qm.events[d.actual]})
 				}
 			}
+			content, err := qm.renderGoldenUpdate(updated)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			writeGolden(t, goldenPath, content)
+			return
 		}
 	}
 
 	// Try assertion, if it fails, show normalized diff
 	defer func() {
-		if t.Failed() && !golden.FlagUpdate() {
+		if t.Failed() {
 			// Read golden file and show normalized comparison
-			if data, err := os.ReadFile(filepath.Join("testdata", filename)); err == nil {
+			if data, err := os.ReadFile(goldenPath); err == nil {
 				goldenContent := string(data)
 
 				// Normalize actual queries for comparison
-				actualNormalized := make([]string, len(qm.queries))
-				for i, query := range qm.queries {
-					actualNormalized[i] = qm.normalizeForComparison(query)
+				actualNormalized := make([]string, len(recorded))
+				for i, entry := range recorded {
+					actualNormalized[i] = qm.comparisonKey(entry, config)
 				}
 
 				// Normalize golden queries for comparison
-				queries := strings.Split(strings.TrimSuffix(goldenContent, ";"), ";\n")
-				goldenNormalized := make([]string, 0, len(queries))
-				for _, query := range queries {
-					if strings.TrimSpace(query) != "" {
-						goldenNormalized = append(goldenNormalized, qm.normalizeForComparison(query))
-					}
+				goldenEntries, _ := qm.parseGoldenFile(goldenContent)
+				goldenNormalized := make([]string, len(goldenEntries))
+				for i, entry := range goldenEntries {
+					goldenNormalized[i] = qm.comparisonKey(entry, config)
 				}
-				// Line-by-line comparison with clear formatting
-				fmt.Printf("\n%s%s=== NORMALIZED COMPARISON ===%s\n", colorBold, colorCyan, colorReset)
-				fmt.Printf("%sExpected: %d queries | Actual: %d queries%s\n", colorBlue, len(goldenNormalized), len(actualNormalized), colorReset)
-				maxLen := len(goldenNormalized)
-				if len(actualNormalized) > maxLen {
-					maxLen = len(actualNormalized)
+				// Diff aligned by the longest common subsequence, so inserted and missing
+				// queries do not shift the queries after them
+				report := qm.newReport()
+				report.printf("\n%s%s=== NORMALIZED COMPARISON ===%s\n", colorBold, colorCyan, colorReset)
+				report.printf("%sExpected: %d queries | Actual: %d queries%s\n", colorBlue, len(goldenNormalized), len(actualNormalized), colorReset)
+				diffs := diffQueries(goldenNormalized, actualNormalized)
+				report.printf("%s", renderQueryDiff(diffs, goldenNormalized, actualNormalized, report.colored))
+				if config.explain {
+					for _, d := range diffs {
+						if d.op != diffChange {
+							continue
+						}
+						report.printf("\n  %sNormalization of [%d→%d]:%s\n", colorYellow, d.expected+1, d.actual+1, colorReset)
+						report.printf("%s", qm.renderTraces(goldenEntries[d.expected].SQL, recorded[d.actual].SQL))
+					}
 				}
 
-				allMatch := true
 				matchCount := 0
-				for i := 0; i < maxLen; i++ {
-					var expected, actual string
-					if i < len(goldenNormalized) {
-						expected = goldenNormalized[i]
+				var changedSteps []string
+				for _, d := range diffs {
+					if d.op == diffEqual {
+						matchCount++
+						continue
 					}
-					if i < len(actualNormalized) {
-						actual = actualNormalized[i]
+					if d.expected >= 0 && goldenEntries[d.expected].Step != "" {
+						changedSteps = append(changedSteps, goldenEntries[d.expected].Step)
 					}
-
-					if expected == actual {
-						matchCount++
-						fmt.Printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, expected)
-					} else {
-						allMatch = false
-						fmt.Printf("  %s[%d]%s %s✗ DIFF:%s\n", colorBlue, i+1, colorReset, colorRed, colorReset)
-						if expected != "" {
-							fmt.Printf("       %s%sExpected:%s %s\n", colorBold, colorYellow, colorReset, expected)
-						} else {
-							fmt.Printf("       %s%sExpected:%s <missing>\n", colorBold, colorYellow, colorReset)
-						}
-						if actual != "" {
-							fmt.Printf("       %s%sActual:%s   %s\n", colorBold, colorYellow, colorReset, actual)
-						} else {
-							fmt.Printf("       %s%sActual:%s   <missing>\n", colorBold, colorYellow, colorReset)
-						}
+					if d.actual >= 0 && recorded[d.actual].Step != "" {
+						changedSteps = append(changedSteps, recorded[d.actual].Step)
 					}
 				}
 
-				if allMatch {
-					fmt.Printf("\n  %s✓ All normalized queries match! The difference is only in formatting.%s\n", colorGreen, colorReset)
+				if matchCount == len(diffs) {
+					report.printf("\n  %s✓ All normalized queries match! The difference is only in formatting.%s\n", colorGreen, colorReset)
 				} else {
-					fmt.Printf("\n  %s✗ Normalized queries have actual differences.%s\n", colorRed, colorReset)
-					fmt.Printf("  %sMatched: %d/%d queries%s\n", colorYellow, matchCount, maxLen, colorReset)
+					report.printf("\n  %s✗ Normalized queries have actual differences.%s\n", colorRed, colorReset)
+					report.printf("  %sMatched: %d/%d queries%s\n", colorYellow, matchCount, len(diffs), colorReset)
+					if len(changedSteps) > 0 {
+						report.printf("  %sChanged steps: %s%s\n", colorYellow, strings.Join(uniqueStrings(changedSteps), ", "), colorReset)
+					}
 				}
+				report.log(t)
 			}
 		}
 	}()
 
-	golden.Assert(t, content, filename)
+	config.assertGolden(t, content, filename)
 }
 
-// filterSubqueries filters out subqueries from a list of queries.
+// filterSubqueries filters out subqueries from a list of recorded events.
 // Subqueries are queries that appear as part of other queries (in JOIN or IN clauses).
 // This is done by checking if each query's normalized form is a substring of any other query.
-func (qm *QueryManager) filterSubqueries(queries []string) []string {
-	if len(queries) <= 1 {
-		return queries
+func (qm *QueryManager) filterSubqueries(events []QueryEvent) []QueryEvent {
+	if len(events) <= 1 {
+		return events
 	}
 
 	// Normalize all queries for comparison
-	normalized := make([]string, len(queries))
-	for i, query := range queries {
-		normalized[i] = qm.normalizeForComparison(query)
+	normalized := make([]string, len(events))
+	for i, event := range events {
+		normalized[i] = qm.normalizeForComparison(event.SQL)
 	}
 
 	// Mark queries that are subqueries
-	isSubquery := make([]bool, len(queries))
+	isSubquery := make([]bool, len(events))
 	for i := 0; i < len(normalized); i++ {
 		for j := 0; j < len(normalized); j++ {
 			if i == j {
@@ -891,10 +1098,10 @@ func (qm *QueryManager) filterSubqueries(queries []string) []string {
 	}
 
 	// Filter out subqueries
-	filtered := make([]string, 0, len(queries))
-	for i, query := range queries {
+	filtered := make([]QueryEvent, 0, len(events))
+	for i, event := range events {
 		if !isSubquery[i] {
-			filtered = append(filtered, query)
+			filtered = append(filtered, event)
 		}
 	}
 
@@ -903,163 +1110,197 @@ func (qm *QueryManager) filterSubqueries(queries []string) []string {
 
 // AssertGoldenSorted asserts the recorded queries against a golden file, ignoring query order.
 // This is useful when queries are executed in parallel and their order is non-deterministic.
-func (qm *QueryManager) AssertGoldenSorted(t *testing.T) {
+func (qm *QueryManager) AssertGoldenSorted(t testing.TB, opts ...AssertOption) {
+	t.Helper()
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
+	qm.checkRules(t)
 
-	// Filter out subqueries first
-	filteredQueries := qm.filterSubqueries(qm.queries)
+	config := newAssertConfig(opts)
 
-	// Sort queries before joining
-	sortedQueries := make([]string, len(filteredQueries))
-	copy(sortedQueries, filteredQueries)
-	sort.Strings(sortedQueries)
+	// Filter out subqueries first
+	filteredEvents := qm.filterSubqueries(qm.events)
+
+	// Sort queries before joining, keeping steps in the order they started
+	sortedEvents := make([]QueryEvent, len(filteredEvents))
+	copy(sortedEvents, filteredEvents)
+	stepOrder := map[string]int{}
+	for _, event := range sortedEvents {
+		if _, ok := stepOrder[event.Step]; !ok {
+			stepOrder[event.Step] = len(stepOrder)
+		}
+	}
+	sort.SliceStable(sortedEvents, func(i, j int) bool {
+		if sortedEvents[i].Step != sortedEvents[j].Step {
+			return stepOrder[sortedEvents[i].Step] < stepOrder[sortedEvents[j].Step]
+		}
+		return sortedEvents[i].SQL < sortedEvents[j].SQL
+	})
+	sortedEntries := make([]goldenEntry, len(sortedEvents))
+	for i, event := range sortedEvents {
+		sortedEntries[i] = qm.entryOf(event)
+	}
 
-	content := strings.Join(sortedQueries, ";\n")
-	if len(sortedQueries) > 0 && content != "" {
-		content += ";"
+	content, err := qm.renderGoldenFile(sortedEvents)
+	if err != nil {
+		t.Fatalf("%v", err)
 	}
 
 	// Use only the filename part for golden.Assert since it automatically looks in testdata/
 	filename := filepath.Base(qm.goldenFile)
 
-	// Check if golden file exists and provide helpful error message (only when not updating)
-	if !golden.FlagUpdate() {
-		goldenPath := filepath.Join("testdata", filename)
-		if _, err := os.Stat(goldenPath); os.IsNotExist(err) {
-			t.Fatalf("Golden file '%s' does not exist.\n\nTo create the golden file:\n1. Run the test with -update flag: go test -update\n   OR\n2. Manually create the file with expected SQL queries\n   OR\n3. Use SaveToFile() method to generate the golden file from recorded queries", goldenPath)
+	goldenPath := filepath.Join("testdata", filename)
+	mode := config.updateMode(t)
+
+	// Create a missing golden file when updating, otherwise explain how to create it
+	if _, err := os.Stat(goldenPath); os.IsNotExist(err) {
+		if mode != UpdateNone {
+			writeGolden(t, goldenPath, content)
+			return
 		}
+		t.Fatalf(missingGoldenMessage, goldenPath)
+	}
 
-		// Perform normalized comparison before golden assertion
-		if data, err := os.ReadFile(goldenPath); err == nil {
-			goldenContent := string(data)
+	// Perform normalized comparison before golden assertion
+	if data, err := os.ReadFile(goldenPath); err == nil {
+		goldenContent := string(data)
 
-			// Normalize and sort actual queries for comparison
-			actualNormalized := make([]string, len(sortedQueries))
-			for i, query := range sortedQueries {
-				actualNormalized[i] = qm.normalizeForComparison(query)
-			}
-			sort.Strings(actualNormalized)
-
-			// Normalize and sort golden queries for comparison
-			queries := strings.Split(strings.TrimSuffix(goldenContent, ";"), ";\n")
-			goldenNormalized := make([]string, 0, len(queries))
-			for _, query := range queries {
-				if strings.TrimSpace(query) != "" {
-					goldenNormalized = append(goldenNormalized, qm.normalizeForComparison(query))
+		// Normalize actual queries for comparison
+		actualNormalized := make([]string, len(sortedEntries))
+		for i, entry := range sortedEntries {
+			actualNormalized[i] = qm.comparisonKey(entry, config)
+		}
+
+		// Normalize golden queries for comparison
+		goldenEntries, err := qm.parseGoldenFile(goldenContent)
+		if err != nil {
+			t.Fatalf("failed to parse golden file '%s': %v", goldenPath, err)
+		}
+		goldenNormalized := make([]string, len(goldenEntries))
+		for i, entry := range goldenEntries {
+			goldenNormalized[i] = qm.comparisonKey(entry, config)
+		}
+
+		// Check if normalized queries match in any order
+		matches := matchSubset(goldenNormalized, actualNormalized)
+		if len(actualNormalized) == len(goldenNormalized) {
+			allMatch := true
+			for _, match := range matches {
+				if match == -1 {
+					allMatch = false
+					break
 				}
 			}
-			sort.Strings(goldenNormalized)
-
-			// Check if normalized queries match
-			if len(actualNormalized) == len(goldenNormalized) {
-				allMatch := true
-				for i := 0; i < len(actualNormalized); i++ {
-					if actualNormalized[i] != goldenNormalized[i] {
-						allMatch = false
-						break
-					}
-				}
 
-				if allMatch {
-					// Show normalized comparison for success case
-					fmt.Printf("\n%s%s=== NORMALIZED COMPARISON (SORTED) ===%s\n", colorBold, colorCyan, colorReset)
-					fmt.Printf("%sTotal queries: %d%s\n", colorBlue, len(actualNormalized), colorReset)
+			if allMatch {
+				// Show normalized comparison for success case when asked to
+				if qm.showMatches() {
+					report := qm.newReport()
+					report.printf("\n%s%s=== NORMALIZED COMPARISON (SORTED) ===%s\n", colorBold, colorCyan, colorReset)
+					report.printf("%sTotal queries: %d%s\n", colorBlue, len(actualNormalized), colorReset)
 					for i := 0; i < len(actualNormalized); i++ {
-						fmt.Printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, actualNormalized[i])
+						report.printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, actualNormalized[i])
 					}
-					fmt.Printf("\n  %s✓ All normalized queries match (order-independent)! The difference is only in formatting/order.%s\n", colorGreen, colorReset)
-					// Return early - test passes
-					return
+					report.printf("\n  %s✓ All normalized queries match (order-independent)! The difference is only in formatting/order.%s\n", colorGreen, colorReset)
+					report.log(t)
+				}
+				// Return early - test passes
+				return
+			}
+		}
+
+		// The recorded queries do not match the golden file: rewrite it in sorted order,
+		// keeping the golden queries that match a recorded one as written
+		if mode == UpdateFailed || mode == UpdateAll {
+			kept := make(map[int]int, len(matches))
+			for i, match := range matches {
+				if match != -1 {
+					kept[match] = i
+				}
+			}
+			updated := make([]goldenUpdate, len(sortedEvents))
+			for j, event := range sortedEvents {
+				if i, ok := kept[j]; ok {
+					updated[j] = goldenUpdate{entry: &goldenEntries[i]}
+				} else {
+					updated[j] = goldenUpdate{event: event}
 				}
 			}
+			content, err := qm.renderGoldenUpdate(updated)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			writeGolden(t, goldenPath, content)
+			return
 		}
 	}
 
 	// Try assertion, if it fails, show normalized diff
 	defer func() {
-		if t.Failed() && !golden.FlagUpdate() {
+		if t.Failed() {
 			// Read golden file and show normalized comparison
-			if data, err := os.ReadFile(filepath.Join("testdata", filename)); err == nil {
+			if data, err := os.ReadFile(goldenPath); err == nil {
 				goldenContent := string(data)
 
 				// Normalize and sort actual queries for comparison
-				actualNormalized := make([]string, len(sortedQueries))
-				for i, query := range sortedQueries {
-					actualNormalized[i] = qm.normalizeForComparison(query)
+				actualNormalized := make([]string, len(sortedEntries))
+				for i, entry := range sortedEntries {
+					actualNormalized[i] = qm.comparisonKey(entry, config)
 				}
 				sort.Strings(actualNormalized)
 
 				// Normalize and sort golden queries for comparison
-				queries := strings.Split(strings.TrimSuffix(goldenContent, ";"), ";\n")
-				goldenNormalized := make([]string, 0, len(queries))
-				for _, query := range queries {
-					if strings.TrimSpace(query) != "" {
-						goldenNormalized = append(goldenNormalized, qm.normalizeForComparison(query))
-					}
+				goldenEntries, _ := qm.parseGoldenFile(goldenContent)
+				goldenNormalized := make([]string, len(goldenEntries))
+				for i, entry := range goldenEntries {
+					goldenNormalized[i] = qm.comparisonKey(entry, config)
 				}
 				sort.Strings(goldenNormalized)
 
-				// Line-by-line comparison with clear formatting
-				fmt.Printf("\n%s%s=== NORMALIZED COMPARISON (SORTED) ===%s\n", colorBold, colorCyan, colorReset)
-				fmt.Printf("%sExpected: %d queries | Actual: %d queries%s\n", colorBlue, len(goldenNormalized), len(actualNormalized), colorReset)
-				maxLen := len(goldenNormalized)
-				if len(actualNormalized) > maxLen {
-					maxLen = len(actualNormalized)
-				}
+				// Diff of the sorted queries aligned by the longest common subsequence
+				report := qm.newReport()
+				report.printf("\n%s%s=== NORMALIZED COMPARISON (SORTED) ===%s\n", colorBold, colorCyan, colorReset)
+				report.printf("%sExpected: %d queries | Actual: %d queries%s\n", colorBlue, len(goldenNormalized), len(actualNormalized), colorReset)
+				diffs := diffQueries(goldenNormalized, actualNormalized)
+				report.printf("%s", renderQueryDiff(diffs, goldenNormalized, actualNormalized, report.colored))
 
-				allMatch := true
 				matchCount := 0
-				for i := 0; i < maxLen; i++ {
-					var expected, actual string
-					if i < len(goldenNormalized) {
-						expected = goldenNormalized[i]
-					}
-					if i < len(actualNormalized) {
-						actual = actualNormalized[i]
-					}
-
-					if expected == actual {
+				for _, d := range diffs {
+					if d.op == diffEqual {
 						matchCount++
-						fmt.Printf("  %s[%d]%s %s✓ MATCH:%s %s\n", colorBlue, i+1, colorReset, colorGreen, colorReset, expected)
-					} else {
-						allMatch = false
-						fmt.Printf("  %s[%d]%s %s✗ DIFF:%s\n", colorBlue, i+1, colorReset, colorRed, colorReset)
-						if expected != "" {
-							fmt.Printf("       %s%sExpected:%s %s\n", colorBold, colorYellow, colorReset, expected)
-						} else {
-							fmt.Printf("       %s%sExpected:%s <missing>\n", colorBold, colorYellow, colorReset)
-						}
-						if actual != "" {
-							fmt.Printf("       %s%sActual:%s   %s\n", colorBold, colorYellow, colorReset, actual)
-						} else {
-							fmt.Printf("       %s%sActual:%s   <missing>\n", colorBold, colorYellow, colorReset)
-						}
 					}
 				}
 
-				if allMatch {
-					fmt.Printf("\n  %s✓ All normalized queries match (order-independent)! The difference is only in formatting/order.%s\n", colorGreen, colorReset)
+				if matchCount == len(diffs) {
+					report.printf("\n  %s✓ All normalized queries match (order-independent)! The difference is only in formatting/order.%s\n", colorGreen, colorReset)
 				} else {
-					fmt.Printf("\n  %s✗ Normalized queries have actual differences.%s\n", colorRed, colorReset)
-					fmt.Printf("  %sMatched: %d/%d queries%s\n", colorYellow, matchCount, maxLen, colorReset)
+					report.printf("\n  %s✗ Normalized queries have actual differences.%s\n", colorRed, colorReset)
+					report.printf("  %sMatched: %d/%d queries%s\n", colorYellow, matchCount, len(diffs), colorReset)
 				}
+				report.log(t)
 			}
 		}
 	}()
 
-	golden.Assert(t, content, filename)
+	config.assertGolden(t, content, filename)
 }
 
-// CompareQueries compares two SQL queries using normalization for comparison
+// CompareQueries compares two SQL queries by their canonical AST form.
+// If either query cannot be parsed, both are compared using string normalization.
 func (qm *QueryManager) CompareQueries(query1, query2 string) bool {
-	normalized1 := qm.normalizeForComparison(query1)
-	normalized2 := qm.normalizeForComparison(query2)
-	return normalized1 == normalized2
+	equal, _, _ := qm.CompareQueriesDebug(query1, query2)
+	return equal
 }
 
-// CompareQueriesDebug compares two SQL queries and returns debug information
+// CompareQueriesDebug compares two SQL queries and returns the forms they were compared in
 func (qm *QueryManager) CompareQueriesDebug(query1, query2 string) (bool, string, string) {
+	canonical1, ok1 := qm.canonicalize(query1)
+	canonical2, ok2 := qm.canonicalize(query2)
+	if ok1 && ok2 {
+		canonical1, canonical2 = qm.applyRules(canonical1), qm.applyRules(canonical2)
+		return canonical1 == canonical2, canonical1, canonical2
+	}
+
 	normalized1 := qm.normalizeForComparison(query1)
 	normalized2 := qm.normalizeForComparison(query2)
 	return normalized1 == normalized2, normalized1, normalized2
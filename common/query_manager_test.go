@@ -1,7 +1,15 @@
 package common
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/po3rin/gormgolden/internal/testutil"
 )
 
 func TestQueryManager_normalize(t *testing.T) {
@@ -196,6 +204,58 @@ func TestQueryManager_normalizeForComparison(t *testing.T) {
 	}
 }
 
+func TestQueryManager_canonicalize(t *testing.T) {
+	qm := NewQueryManager("")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "AND operands are sorted and parentheses kept where needed",
+			input:    "SELECT * FROM users WHERE ((c=3 OR b=2)) AND a = 1",
+			expected: "SELECT * FROM `users` WHERE (`b`=2 OR `c`=3) AND `a`=1",
+		},
+		{
+			name:     "redundant parentheses are removed",
+			input:    "SELECT * FROM users WHERE ((a=1) AND (b=2)) OR (c=3)",
+			expected: "SELECT * FROM `users` WHERE `a`=1 AND `b`=2 OR `c`=3",
+		},
+		{
+			name:     "duplicate conditions are removed",
+			input:    "SELECT * FROM users WHERE a=1 AND a=1",
+			expected: "SELECT * FROM `users` WHERE `a`=1",
+		},
+		{
+			name:     "LIMIT OFFSET is restored as offset,count",
+			input:    "SELECT * FROM users LIMIT 10 OFFSET 5",
+			expected: "SELECT * FROM `users` LIMIT 5,10",
+		},
+		{
+			name:     "charset introducers are dropped",
+			input:    "SELECT * FROM users WHERE name=_UTF8MB4'abc' AND org_id=_UTF8MB4ABC",
+			expected: "SELECT * FROM `users` WHERE `name`='abc' AND `org_id`=`ABC`",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := qm.canonicalize(tt.input)
+			if !ok {
+				t.Fatalf("canonicalize() failed to parse %q", tt.input)
+			}
+			if result != tt.expected {
+				t.Errorf("canonicalize() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+
+	if _, ok := qm.canonicalize("NOT A QUERY"); ok {
+		t.Error("canonicalize() should report unparseable queries")
+	}
+}
+
 func TestQueryManager_CompareQueries(t *testing.T) {
 	qm := NewQueryManager("test.golden.sql")
 	
@@ -235,6 +295,90 @@ func TestQueryManager_CompareQueries(t *testing.T) {
 			query2:   "SELECT * FROM user_settings WHERE user_settings.config_id IN XYZ789ABC123DEF456GHI AND user_settings.org_id=ABC123DEF456GHI789JKL012",
 			expected: true,
 		},
+		{
+			name:     "AND over OR should not match OR over AND",
+			query1:   "SELECT * FROM users WHERE a=1 AND (b=2 OR c=3)",
+			query2:   "SELECT * FROM users WHERE (a=1 AND b=2) OR c=3",
+			expected: false,
+		},
+		{
+			name:     "reordered operands inside nested OR should match",
+			query1:   "SELECT * FROM users WHERE a=1 AND (b=2 OR c=3)",
+			query2:   "SELECT * FROM users WHERE (c=3 OR b=2) AND a=1",
+			expected: true,
+		},
+		{
+			name:     "subquery with WHERE should match reordered outer conditions",
+			query1:   "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders WHERE total>10 AND paid=1) AND name='x'",
+			query2:   "SELECT * FROM users WHERE name='x' AND id IN (SELECT user_id FROM orders WHERE paid=1 AND total>10)",
+			expected: true,
+		},
+		{
+			name:     "subqueries with different WHERE should not match",
+			query1:   "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders WHERE total>10)",
+			query2:   "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders WHERE total>20)",
+			expected: false,
+		},
+		{
+			name:     "LIMIT offset forms should match",
+			query1:   "SELECT * FROM users LIMIT 10 OFFSET 20",
+			query2:   "SELECT * FROM users LIMIT 20,10",
+			expected: true,
+		},
+		{
+			name:     "zero OFFSET should match plain LIMIT",
+			query1:   "SELECT * FROM users LIMIT 10 OFFSET 0",
+			query2:   "SELECT * FROM users LIMIT 10",
+			expected: true,
+		},
+		{
+			name:     "INNER JOIN order should not matter",
+			query1:   "SELECT * FROM a JOIN c ON c.id=a.id JOIN b ON b.id=a.id",
+			query2:   "SELECT * FROM a JOIN b ON b.id=a.id JOIN c ON c.id=a.id",
+			expected: true,
+		},
+		{
+			name:     "INNER JOINs should be sorted after the tables they reference",
+			query1:   "SELECT * FROM t JOIN b ON b.id=t.b_id JOIN c ON c.id=b.c_id JOIN a ON a.id=t.a_id",
+			query2:   "SELECT * FROM t JOIN a ON a.id=t.a_id JOIN b ON b.id=t.b_id JOIN c ON c.id=b.c_id",
+			expected: true,
+		},
+		{
+			name:     "INNER JOIN should not move before the table its ON clause references",
+			query1:   "SELECT * FROM t JOIN b ON b.id=t.b_id JOIN a ON a.id=b.a_id",
+			query2:   "SELECT * FROM t JOIN a ON a.id=b.a_id JOIN b ON b.id=t.b_id",
+			expected: false,
+		},
+		{
+			name:     "LEFT JOINs should not be reordered",
+			query1:   "SELECT * FROM a LEFT JOIN c ON c.id=a.id LEFT JOIN b ON b.id=a.id",
+			query2:   "SELECT * FROM a LEFT JOIN b ON b.id=a.id LEFT JOIN c ON c.id=a.id",
+			expected: false,
+		},
+		{
+			name:     "LEFT JOIN should not move before the INNER JOIN it depends on",
+			query1:   "SELECT * FROM t JOIN a ON a.id=t.a_id LEFT JOIN b ON b.id=a.b_id",
+			query2:   "SELECT * FROM t LEFT JOIN b ON b.id=a.b_id JOIN a ON a.id=t.a_id",
+			expected: false,
+		},
+		{
+			name:     "INNER JOINs should not move across a LEFT JOIN",
+			query1:   "SELECT * FROM t JOIN b ON b.id=t.b_id LEFT JOIN c ON c.id=t.c_id JOIN a ON a.id=t.a_id",
+			query2:   "SELECT * FROM t JOIN a ON a.id=t.a_id LEFT JOIN c ON c.id=t.c_id JOIN b ON b.id=t.b_id",
+			expected: false,
+		},
+		{
+			name:     "charset introducers should match plain strings",
+			query1:   "SELECT * FROM users WHERE name=_UTF8MB4'abc'",
+			query2:   "SELECT * FROM users WHERE name='abc'",
+			expected: true,
+		},
+		{
+			name:     "arithmetic precedence should be preserved",
+			query1:   "SELECT (a+b)*c FROM t",
+			query2:   "SELECT a+b*c FROM t",
+			expected: false,
+		},
 	}
 	
 	for _, tt := range tests {
@@ -242,9 +386,1310 @@ func TestQueryManager_CompareQueries(t *testing.T) {
 			result := qm.CompareQueries(tt.query1, tt.query2)
 			if result != tt.expected {
 				t.Errorf("CompareQueries() = %v, want %v", result, tt.expected)
-				t.Logf("Query1 normalized: %q", qm.normalizeForComparison(tt.query1))
-				t.Logf("Query2 normalized: %q", qm.normalizeForComparison(tt.query2))
+				t.Logf("Query1 normalized: %q", qm.comparisonForm(tt.query1))
+				t.Logf("Query2 normalized: %q", qm.comparisonForm(tt.query2))
+			}
+		})
+	}
+}
+
+func TestQueryManager_AddEvent(t *testing.T) {
+	qm := NewQueryManager("")
+
+	qm.AddEvent(QueryEvent{
+		SQL:          "select * from users where id = 1",
+		RawSQL:       "select * from users where id = ?",
+		Vars:         []interface{}{1},
+		Operation:    OperationQuery,
+		Table:        "users",
+		RowsAffected: 1,
+	})
+	qm.AddQuery("SELECT * FROM posts")
+	qm.Clear()
+	qm.AddQuery("SELECT * FROM comments")
+
+	events := qm.GetEvents()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	if events[0].Sequence != 3 {
+		t.Errorf("Sequence = %d, want 3 (sequence keeps increasing across Clear)", events[0].Sequence)
+	}
+	if events[0].Timestamp.IsZero() {
+		t.Error("Timestamp should be filled in")
+	}
+
+	qm.Clear()
+	qm.AddEvent(QueryEvent{
+		SQL:       "select * from users where id = 1",
+		RawSQL:    "select * from users where id = ?",
+		Vars:      []interface{}{1},
+		Operation: OperationQuery,
+		Table:     "users",
+	})
+	event := qm.GetEvents()[0]
+	if event.SQL != "SELECT * FROM `users` WHERE `id`=1" {
+		t.Errorf("SQL = %q, want normalized query", event.SQL)
+	}
+	if event.RawSQL != "select * from users where id = ?" {
+		t.Errorf("RawSQL = %q, want it untouched", event.RawSQL)
+	}
+	if event.Operation != OperationQuery || event.Table != "users" {
+		t.Errorf("Operation/Table = %q/%q, want query/users", event.Operation, event.Table)
+	}
+	if queries := qm.GetQueries(); len(queries) != 1 || queries[0] != event.SQL {
+		t.Errorf("GetQueries() = %q, want projection of event SQL", queries)
+	}
+}
+
+func TestQueryManager_CallerComments(t *testing.T) {
+	qm := NewQueryManager("", WithCallerComments())
+	qm.AddEvent(QueryEvent{
+		SQL:    "SELECT * FROM users WHERE id = 1",
+		Caller: Caller{File: "/src/app/repo/user.go", Line: 42, Function: "app/repo.(*UserRepo).Find"},
+	})
+
+	content := qm.renderGolden(qm.GetEvents())
+	expected := "-- caller: repo/user.go:42\nSELECT * FROM `users` WHERE `id`=1;"
+	if content != expected {
+		t.Errorf("renderGolden() = %q, want %q", content, expected)
+	}
+
+	if !qm.CompareQueries("-- caller: repo/user.go:42\nSELECT * FROM `users` WHERE `id`=1", "SELECT * FROM `users` WHERE `id`=1") {
+		t.Error("caller comments should be ignored by comparison")
+	}
+}
+
+func TestQueryManager_Dialect(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		version  GORMVersion
+		input    string
+		expected string
+	}{
+		{
+			name:     "PostgreSQL placeholders and quoted identifiers",
+			dialect:  DialectPostgres,
+			input:    `SELECT * FROM "users" WHERE "users"."id" = $1 AND "name" ILIKE $2`,
+			expected: "SELECT * FROM `users` WHERE `users`.`id`=? AND `name` ILIKE ?",
+		},
+		{
+			name:     "PostgreSQL casts are kept",
+			dialect:  DialectPostgres,
+			input:    `SELECT * FROM "events" WHERE "created_at" > '2024-01-01'::timestamp AND "tags" = '{}'::varchar(16)[]`,
+			expected: "SELECT * FROM `events` WHERE `created_at`>'2024-01-01'::timestamp AND `tags`='{}'::varchar(16)[]",
+		},
+		{
+			name:     "PostgreSQL casts of placeholders are kept",
+			dialect:  DialectPostgres,
+			input:    `SELECT * FROM "users" WHERE "id" = $1::bigint AND ("age" + 1)::int > 2`,
+			expected: "SELECT * FROM `users` WHERE `id`=?::bigint AND (`age`+1)::int>2",
+		},
+		{
+			name:     "PostgreSQL ANY and ALL of an array are kept",
+			dialect:  DialectPostgres,
+			input:    `SELECT * FROM "users" WHERE "id" = ANY($1) AND "age" <> all('{1,2}'::int[]) AND "id" IN (SELECT "user_id" FROM "orders")`,
+			expected: "SELECT * FROM `users` WHERE `id`=ANY(?) AND `age`!=ALL('{1,2}'::int[]) AND `id` IN (SELECT `user_id` FROM `orders`)",
+		},
+		{
+			name:     "PostgreSQL ANY of a subquery",
+			dialect:  DialectPostgres,
+			input:    `SELECT * FROM "users" WHERE "id" = ANY (SELECT "user_id" FROM "orders")`,
+			expected: "SELECT * FROM `users` WHERE `id`=ANY (SELECT `user_id` FROM `orders`)",
+		},
+		{
+			name:     "PostgreSQL RETURNING clause is kept",
+			dialect:  DialectPostgres,
+			input:    `INSERT INTO "users" ("name","age") VALUES ('Alice',28) RETURNING "id", "name"`,
+			expected: "INSERT INTO `users` (`name`,`age`) VALUES ('Alice',28) RETURNING `id`,`name`",
+		},
+		{
+			name:     "SQLite GORM v2 double-quoted strings",
+			dialect:  DialectSQLite,
+			input:    "INSERT INTO `users` (`name`) VALUES (\"O'Brien\") RETURNING `id`",
+			expected: "INSERT INTO `users` (`name`) VALUES ('O''Brien') RETURNING `id`",
+		},
+		{
+			name:     "SQLite GORM v2 double-quoted strings without backticks",
+			dialect:  DialectSQLite,
+			input:    `UPDATE users SET name = "x" WHERE id = 1`,
+			expected: "UPDATE `users` SET `name`='x' WHERE `id`=1",
+		},
+		{
+			name:     "SQLite GORM v1 double-quoted identifiers",
+			dialect:  DialectSQLite,
+			version:  GORMv1,
+			input:    `SELECT * FROM "products" WHERE ("products"."price" > 500)`,
+			expected: "SELECT * FROM `products` WHERE (`products`.`price`>500)",
+		},
+		{
+			name:     "SQLite GORM v1 backtick in a string",
+			dialect:  DialectSQLite,
+			version:  GORMv1,
+			input:    "SELECT * FROM \"users\" WHERE \"name\" = 'a`b'",
+			expected: "SELECT * FROM `users` WHERE `name`='a`b'",
+		},
+		{
+			name:     "MySQL is unchanged",
+			dialect:  DialectMySQL,
+			input:    `SELECT * FROM users WHERE name = "Alice"`,
+			expected: "SELECT * FROM `users` WHERE `name`=_UTF8MB4Alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := NewQueryManager("", WithDialect(tt.dialect), WithGORMVersion(tt.version))
+			result := qm.normalize(tt.input)
+			if result != tt.expected {
+				t.Errorf("normalize() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+
+	v1 := NewQueryManager("", WithDialect(DialectSQLite), WithGORMVersion(GORMv1))
+	v2 := NewQueryManager("", WithDialect(DialectSQLite))
+	if v1.comparisonForm(`SELECT * FROM "products" WHERE (price > 500)`) != v2.comparisonForm("SELECT * FROM `products` WHERE `price`>500") {
+		t.Error("comparison forms should match for GORM v1 and v2 SQLite quoting")
+	}
+	pg := NewQueryManager("", WithDialect(DialectPostgres))
+	if pg.CompareQueries(`SELECT * FROM "users" WHERE "id" = $1`, `SELECT * FROM "users" WHERE "id" = $1::bigint`) {
+		t.Error("CompareQueries() should not match PostgreSQL queries differing by a cast")
+	}
+	if _, parsed := pg.canonicalize(`SELECT * FROM "users" WHERE "id" = ANY($1)`); !parsed {
+		t.Error("canonicalize() should parse comparisons with ANY of an array")
+	}
+	if !pg.CompareQueries(`SELECT * FROM "users" WHERE "id" = ANY($1) AND "age" > 20`, `select * from users where age > 20 and id = any($1)`) {
+		t.Error("CompareQueries() should match comparisons with ANY of an array in any order")
+	}
+	if !v2.CompareQueries("SELECT * FROM `users` WHERE `name`=_UTF8MB4Grace", `SELECT * FROM users WHERE name = "Grace"`) {
+		t.Error("CompareQueries() should match strings restored the MySQL way in older golden files")
+	}
+}
+
+func TestDialectFromName(t *testing.T) {
+	for name, expected := range map[string]Dialect{
+		"postgres": DialectPostgres,
+		"sqlite":   DialectSQLite,
+		"sqlite3":  DialectSQLite,
+		"mysql":    DialectMySQL,
+		"unknown":  DialectMySQL,
+	} {
+		if d := DialectFromName(name); d != expected {
+			t.Errorf("DialectFromName(%q) = %q, want %q", name, d, expected)
+		}
+	}
+}
+
+func TestQueryManager_Parameterized(t *testing.T) {
+	qm := NewQueryManager("", WithParameterized())
+	name := "Alice"
+	qm.AddEvent(QueryEvent{
+		SQL:    "INSERT INTO users (name,age,note) VALUES ('Alice',28,NULL)",
+		RawSQL: "INSERT INTO users (name,age,note) VALUES (?,?,?)",
+		Vars:   []interface{}{&name, 28, nil},
+	})
+
+	expected := "-- args: [\"Alice\",28,null]\nINSERT INTO `users` (`name`,`age`,`note`) VALUES (?,?,?);"
+	if content := qm.renderGolden(qm.GetEvents()); content != expected {
+		t.Errorf("renderGolden() = %q, want %q", content, expected)
+	}
+
+	entries := parseGoldenEntries(expected)
+	if len(entries) != 1 || entries[0].Args != `["Alice",28,null]` {
+		t.Fatalf("parseGoldenEntries() = %+v", entries)
+	}
+
+	changed := goldenEntry{SQL: entries[0].SQL, Args: `["Bob", 30, null]`}
+	if qm.comparisonKey(entries[0], assertConfig{}) == qm.comparisonKey(changed, assertConfig{}) {
+		t.Error("entries with different args should not match by default")
+	}
+	if qm.comparisonKey(entries[0], assertConfig{shapeOnly: true}) != qm.comparisonKey(changed, assertConfig{shapeOnly: true}) {
+		t.Error("entries with different args should match with ShapeOnly")
+	}
+	if qm.comparisonKey(entries[0], assertConfig{}) != qm.comparisonKey(goldenEntry{SQL: entries[0].SQL, Args: `[ "Alice", 28, null ]`}, assertConfig{}) {
+		t.Error("args formatting should be ignored")
+	}
+
+	// The args of IN lists are compared as a set, like the values of IN lists
+	in := goldenEntry{SQL: "SELECT * FROM `users` WHERE `id` IN (?,?,?) AND `age`>?", Args: `[3,1,2,30]`}
+	tests := []struct {
+		name  string
+		opts  []Option
+		args  string
+		equal bool
+	}{
+		{"IN list args in another order", nil, `[1,2,3,30]`, true},
+		{"args outside the IN list", nil, `[1,2,30,3]`, false},
+		{"IN list order turned off", []Option{WithoutRules(RuleInListOrder)}, `[1,2,3,30]`, false},
+		{"wildcard among sorted args", nil, `[1,2,"<ANY>",30]`, true},
+		{"wildcard keeps the order", nil, `["<ANY>",1,2,30]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := NewQueryManager("", append([]Option{WithParameterized()}, tt.opts...)...)
+			golden, recorded := qm.comparisonKey(goldenEntry{SQL: in.SQL, Args: tt.args}, assertConfig{}), qm.comparisonKey(in, assertConfig{})
+			if equal := keysMatch(golden, recorded); equal != tt.equal {
+				t.Errorf("golden %s against %s = %v, want %v", golden, recorded, equal, tt.equal)
+			}
+		})
+	}
+}
+
+func TestQueryManager_ShapeOnly(t *testing.T) {
+	qm := NewQueryManager("")
+	shape := func(query string) string {
+		return qm.comparisonKey(goldenEntry{SQL: query}, assertConfig{shapeOnly: true})
+	}
+
+	if shape("SELECT * FROM `users` WHERE `name`=_UTF8MB4Alice AND `age`>25 LIMIT 10") != shape("SELECT * FROM users WHERE age > ? AND name = 'Bob' LIMIT 20") {
+		t.Error("queries differing only in literal values should have the same shape")
+	}
+	if shape("SELECT * FROM users WHERE age > 25") == shape("SELECT * FROM users WHERE age < 25") {
+		t.Error("queries with different operators should have different shapes")
+	}
+}
+
+func TestQueryManager_Maskers(t *testing.T) {
+	qm := NewQueryManager("", WithDialect(DialectSQLite), WithMaskers(DefaultMaskers()...))
+	qm.AddQuery("INSERT INTO `sessions` (`id`,`token`,`created_at`,`expires_at`) VALUES (\"01ARZ3NDEKTSV4RRFFQ69G5FAV\",\"f47ac10b-58cc-4372-a567-0e02b2c3d479\",\"2024-05-01 10:00:00.123\",\"2024-05-01T11:00:00+09:00\")")
+
+	expected := "INSERT INTO `sessions` (`id`,`token`,`created_at`,`expires_at`) VALUES ('<ULID>','<UUID>','<TIMESTAMP>','<TIMESTAMP>')"
+	if queries := qm.GetQueries(); len(queries) != 1 || queries[0] != expected {
+		t.Errorf("GetQueries() = %q, want %q", queries, expected)
+	}
+
+	// Golden queries written before masking was enabled still match
+	if !qm.CompareQueries(expected, "INSERT INTO `sessions` (`id`,`token`,`created_at`,`expires_at`) VALUES ('01BX5ZZKBKACTAV9WEVGEMMVRY','9b2e1c4e-0d1a-4c5e-8f3a-2b7c6d5e4f30','2023-01-01 00:00:00','2023-01-01T01:00:00Z')") {
+		t.Error("CompareQueries() should compare masked values")
+	}
+
+	// MySQL normalization restores strings without quotes
+	mysql := NewQueryManager("", WithMaskers(TimestampMasker()))
+	mysql.AddQuery("UPDATE `users` SET `updated_at`='2024-05-01 10:00:00' WHERE `id`=1")
+	if !mysql.CompareQueries(mysql.GetQueries()[0], "UPDATE `users` SET `updated_at`=_UTF8MB42023-12-31 23:59:59 WHERE `id`=1") {
+		t.Errorf("CompareQueries() should mask MySQL normalized timestamps, recorded %q", mysql.GetQueries()[0])
+	}
+}
+
+func TestColumnMasker(t *testing.T) {
+	tests := []struct {
+		name     string
+		masker   Masker
+		input    string
+		expected string
+	}{
+		{
+			name:     "INSERT values",
+			masker:   ColumnMasker("users.id", "<ID>"),
+			input:    "INSERT INTO users (id,name) VALUES (42,'Alice'),(43,'Bob')",
+			expected: "INSERT INTO `users` (`id`,`name`) VALUES ('<ID>','Alice'),('<ID>','Bob')",
+		},
+		{
+			name:     "UPDATE assignments and conditions",
+			masker:   ColumnMasker("users.id", "<ID>"),
+			input:    "UPDATE users SET name='Alice' WHERE users.id=42",
+			expected: "UPDATE `users` SET `name`='Alice' WHERE `users`.`id`='<ID>'",
+		},
+		{
+			name:     "aliased table and IN list",
+			masker:   ColumnMasker("users.id", "<ID>"),
+			input:    "SELECT * FROM users AS u WHERE u.id IN (1,2)",
+			expected: "SELECT * FROM `users` AS `u` WHERE `u`.`id` IN ('<ID>','<ID>')",
+		},
+		{
+			name:     "other tables are not masked",
+			masker:   ColumnMasker("users.id", "<ID>"),
+			input:    "SELECT * FROM posts WHERE id=1",
+			expected: "SELECT * FROM posts WHERE id=1",
+		},
+		{
+			name:     "column without table",
+			masker:   ColumnMasker("created_at", TimestampToken),
+			input:    "SELECT * FROM posts WHERE created_at>'yesterday' AND id=?",
+			expected: "SELECT * FROM `posts` WHERE `created_at`>'<TIMESTAMP>' AND `id`=?",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.masker.Mask(tt.input); result != tt.expected {
+				t.Errorf("Mask() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestQueryManager_FindNPlusOne(t *testing.T) {
+	qm := NewQueryManager("")
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users`", RawSQL: "SELECT * FROM `users`"})
+	for id := 1; id <= 3; id++ {
+		qm.AddEvent(QueryEvent{
+			SQL:    fmt.Sprintf("SELECT * FROM `posts` WHERE `user_id`=%d", id),
+			RawSQL: "SELECT * FROM `posts` WHERE `user_id` = ?",
+			Caller: Caller{File: "/src/repo/user.go", Line: 42},
+		})
+	}
+	// Inlined queries without placeholders are grouped by shape too
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `posts` WHERE `user_id`=4", Caller: Caller{File: "/src/repo/post.go", Line: 7}})
+
+	if found := qm.FindNPlusOne(4); len(found) != 0 {
+		t.Errorf("FindNPlusOne(4) = %+v, want none", found)
+	}
+
+	found := qm.FindNPlusOne(2)
+	if len(found) != 1 {
+		t.Fatalf("FindNPlusOne(2) = %+v, want 1 shape", found)
+	}
+	if found[0].Count != 4 || found[0].Shape != "SELECT * FROM `posts` WHERE `user_id`=?" {
+		t.Errorf("FindNPlusOne(2) = %+v", found[0])
+	}
+	expectedCallers := []CallerCount{{Caller: "repo/user.go:42", Count: 3}, {Caller: "repo/post.go:7", Count: 1}}
+	if !reflect.DeepEqual(found[0].Callers, expectedCallers) {
+		t.Errorf("Callers = %+v, want %+v", found[0].Callers, expectedCallers)
+	}
+
+	// Inserting rows in a loop is not an N+1 unless writes are included
+	for id := 1; id <= 3; id++ {
+		qm.AddEvent(QueryEvent{
+			SQL:    fmt.Sprintf("INSERT INTO `posts` (`user_id`) VALUES (%d)", id),
+			RawSQL: "INSERT INTO `posts` (`user_id`) VALUES (?)",
+		})
+	}
+	if found := qm.FindNPlusOne(2); len(found) != 1 {
+		t.Errorf("FindNPlusOne(2) = %+v, want the INSERT loop not flagged", found)
+	}
+	found = qm.FindNPlusOne(2, IncludeWrites())
+	if len(found) != 2 || found[1].Shape != "INSERT INTO `posts` (`user_id`) VALUES (?)" || found[1].Count != 3 {
+		t.Errorf("FindNPlusOne(2, IncludeWrites()) = %+v, want the INSERT loop flagged", found)
+	}
+}
+
+func TestQueryManager_Budget(t *testing.T) {
+	qm := NewQueryManager("", WithDialect(DialectSQLite))
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `id`=1", Table: "users"})
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `id`=2", Table: "users"})
+	qm.AddEvent(QueryEvent{SQL: "INSERT INTO `orders` (`user_id`) VALUES (1) RETURNING `id`", Table: "orders"})
+	qm.AddEvent(QueryEvent{SQL: "SELECT `orders`.* FROM `orders` JOIN `users` ON `users`.`id`=`orders`.`user_id`"})
+
+	tests := []struct {
+		name     string
+		assert   func(t testing.TB)
+		failures int
+	}{
+		{"exact count", func(t testing.TB) { qm.AssertQueryCount(t, 4) }, 0},
+		{"wrong count", func(t testing.TB) { qm.AssertQueryCount(t, 3) }, 1},
+		{"within maximum", func(t testing.TB) { qm.AssertMaxQueries(t, 4) }, 0},
+		{"over maximum", func(t testing.TB) { qm.AssertMaxQueries(t, 3) }, 1},
+		{"within budget", func(t testing.TB) {
+			qm.AssertBudget(t, Budget{Select: 3, Insert: 1, Tables: map[string]int{"orders": 2, "users": 3, "audit": 0}})
+		}, 0},
+		{"unlimited", func(t testing.TB) { qm.AssertBudget(t, Budget{Select: Unlimited, Insert: -1, Tables: map[string]int{"orders": Unlimited}}) }, 0},
+		{"over statement budget", func(t testing.TB) { qm.AssertBudget(t, Budget{Select: 2, Insert: Unlimited}) }, 1},
+		{"over table budget", func(t testing.TB) { qm.AssertBudget(t, Budget{Select: Unlimited, Insert: Unlimited, Tables: map[string]int{"orders": 1}}) }, 1},
+		{"zero statement budget", func(t testing.TB) { qm.AssertBudget(t, Budget{Select: Unlimited}) }, 1},
+		{"zero table budget", func(t testing.TB) { qm.AssertBudget(t, Budget{Select: Unlimited, Insert: Unlimited, Tables: map[string]int{"orders": 0}}) }, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &testutil.FailureRecorder{TB: t}
+			tt.assert(recorder)
+			if len(recorder.Failures) != tt.failures {
+				t.Errorf("got failures %q, want %d", recorder.Failures, tt.failures)
+			}
+		})
+	}
+}
+
+func TestQueryManager_ReportColors(t *testing.T) {
+	tests := []struct {
+		name    string
+		noColor string
+		opts    []Option
+		colored bool
+	}{
+		{"forced on", "", []Option{WithColor(true)}, true},
+		{"forced off", "", []Option{WithColor(false)}, false},
+		{"NO_COLOR", "1", nil, false},
+		{"forced on despite NO_COLOR", "1", []Option{WithColor(true)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.noColor)
+			qm := NewQueryManager("", tt.opts...)
+			qm.AddQuery("SELECT * FROM `users`")
+
+			recorder := &testutil.FailureRecorder{TB: t}
+			qm.AssertQueryCount(recorder, 2)
+			if len(recorder.Logs) != 1 {
+				t.Fatalf("got logs %q, want one report", recorder.Logs)
+			}
+			if !strings.Contains(recorder.Logs[0], "=== QUERY COUNT ===") || !strings.Contains(recorder.Logs[0], "SELECT * FROM `users`") {
+				t.Errorf("report = %q, want the query count and the recorded queries", recorder.Logs[0])
+			}
+			if colored := strings.Contains(recorder.Logs[0], "\033["); colored != tt.colored {
+				t.Errorf("report = %q, colored %v, want %v", recorder.Logs[0], colored, tt.colored)
+			}
+		})
+	}
+}
+
+func TestQueryManager_Verbosity(t *testing.T) {
+	tests := []struct {
+		verbosity Verbosity
+		want      bool
+	}{
+		{VerbosityAuto, testing.Verbose()},
+		{VerbosityQuiet, false},
+		{VerbosityVerbose, true},
+	}
+
+	for _, tt := range tests {
+		qm := NewQueryManager("", WithVerbosity(tt.verbosity))
+		if got := qm.showMatches(); got != tt.want {
+			t.Errorf("showMatches() with verbosity %d = %v, want %v", tt.verbosity, got, tt.want)
+		}
+	}
+}
+
+func TestMatchSubsequenceAndSubset(t *testing.T) {
+	recorded := []string{"flags", "a", "audit", "b", "a"}
+
+	tests := []struct {
+		name     string
+		match    func(expected, actual []string) []int
+		expected []string
+		want     []int
+	}{
+		{"ordered subsequence", matchSubsequence, []string{"a", "b", "a"}, []int{1, 3, 4}},
+		{"out of order", matchSubsequence, []string{"b", "flags"}, []int{3, -1}},
+		{"subset in any order", matchSubset, []string{"b", "flags", "a"}, []int{3, 0, 1}},
+		{"duplicates are counted", matchSubset, []string{"audit", "audit"}, []int{2, -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match(tt.expected, recorded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryManager_Wildcards(t *testing.T) {
+	qm := NewQueryManager("")
+	matches := func(golden, recorded string) bool {
+		return keysMatch(qm.comparisonKey(goldenEntry{SQL: golden}, assertConfig{}), qm.comparisonKey(goldenEntry{SQL: recorded}, assertConfig{}))
+	}
+
+	tests := []struct {
+		name     string
+		golden   string
+		recorded string
+		want     bool
+	}{
+		{"any literal", "SELECT * FROM users WHERE id = <ANY>", "SELECT * FROM `users` WHERE `id`=42", true},
+		{"any string", "SELECT * FROM users WHERE name = <ANY> AND age > 20", "SELECT * FROM `users` WHERE `age`>20 AND `name`='Alice'", true},
+		{"any expression", "SELECT * FROM users WHERE id = <ANY>", "SELECT * FROM users WHERE id = (1 + 2)", true},
+		{"any subquery", "SELECT * FROM users WHERE id = <ANY>", "SELECT * FROM users WHERE id = (SELECT MAX(id) FROM users)", true},
+		{"any does not span conditions", "SELECT * FROM users WHERE id = <ANY>", "SELECT * FROM users WHERE id = 1 AND age > 20", false},
+		{"any does not span a list", "INSERT INTO users (name,age) VALUES (<ANY>)", "INSERT INTO users (name,age) VALUES ('Alice',28)", false},
+		{"list of values", "SELECT * FROM users WHERE id IN (<LIST>)", "SELECT * FROM users WHERE id IN (1,2,3)", true},
+		{"list of one value", "SELECT * FROM users WHERE id IN (<LIST>)", "SELECT * FROM users WHERE id IN (1)", true},
+		{"list of one value NOT IN", "SELECT * FROM users WHERE id NOT IN (<LIST>)", "SELECT * FROM users WHERE id NOT IN (1)", true},
+		{"list subquery", "SELECT * FROM users WHERE id IN (<LIST>)", "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders)", true},
+		{"rest of query must match", "SELECT * FROM users WHERE id IN (<LIST>)", "SELECT * FROM orders WHERE id IN (1,2)", false},
+		{"quoted wildcard", "UPDATE users SET name='<ANY>' WHERE id=1", "UPDATE `users` SET `name`='Bob' WHERE `id`=1", true},
+		{"any limit", "SELECT * FROM users WHERE id > 1 LIMIT <ANY>", "SELECT * FROM `users` WHERE `id`>1 LIMIT 10", true},
+		{"any offset", "SELECT * FROM users LIMIT 10 OFFSET <ANY>", "SELECT * FROM `users` LIMIT 10 OFFSET 20", true},
+		{"any limit and offset", "SELECT * FROM users LIMIT <ANY>,<ANY>", "SELECT * FROM `users` LIMIT 10 OFFSET 20", true},
+		{"any limit does not span the offset", "SELECT * FROM users LIMIT <ANY>", "SELECT * FROM `users` LIMIT 10 OFFSET 20", false},
+		{"any sorting before a value", "SELECT * FROM `t` WHERE `a`=<ANY> AND `a`=1", "SELECT * FROM `t` WHERE `a`='foo' AND `a`=1", true},
+		{"any sorting after a value", "SELECT * FROM `t` WHERE `a`=<ANY> AND `a`=1", "SELECT * FROM `t` WHERE `a`=1 AND `a`=9", true},
+		{"any among OR operands", "SELECT * FROM `t` WHERE `b`=2 AND (`a`=1 OR `a`=<ANY>)", "SELECT * FROM `t` WHERE (`a`='x' OR `a`=1) AND `b`=2", true},
+		{"any in a set still needs the other values", "SELECT * FROM `t` WHERE `a`=<ANY> AND `a`=1", "SELECT * FROM `t` WHERE `a`='foo' AND `a`=2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(tt.golden, tt.recorded); got != tt.want {
+				t.Errorf("golden %q against %q = %v, want %v", tt.golden, tt.recorded, got, tt.want)
+			}
+		})
+	}
+
+	args := qm.comparisonKey(goldenEntry{SQL: "SELECT * FROM users WHERE name = ? AND age > ?", Args: `["<ANY>", 20]`}, assertConfig{})
+	if !keysMatch(args, qm.comparisonKey(goldenEntry{SQL: "SELECT * FROM users WHERE name = ? AND age > ?", Args: `["Alice",20]`}, assertConfig{})) {
+		t.Errorf("args wildcard %q should match any value", args)
+	}
+
+	// Concrete golden queries take their recorded queries before wildcards do
+	recorded := []string{"SELECT * FROM `users` WHERE `id`=1", "SELECT * FROM `users` WHERE `id`=2"}
+	expected := []string{"SELECT * FROM `users` WHERE `id`=<ANY>", "SELECT * FROM `users` WHERE `id`=1"}
+	if got := matchSubset(expected, recorded); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Errorf("matchSubset() = %v, want [1 0]", got)
+	}
+
+	// A wildcard matching several recorded queries gives up the one another golden query needs
+	key := func(query string) string { return qm.comparisonKey(goldenEntry{SQL: query}, assertConfig{}) }
+	recorded = []string{key("SELECT * FROM `users` WHERE `id` IN (1,2)"), key("SELECT * FROM `users` WHERE `id` IN (1,3)")}
+	expected = []string{key("SELECT * FROM `users` WHERE `id` IN (<LIST>)"), key("SELECT * FROM `users` WHERE `id` IN (<ANY>,2)")}
+	if got := matchSubset(expected, recorded); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Errorf("matchSubset() of overlapping wildcards = %v, want [1 0]", got)
+	}
+}
+
+func TestQueryManager_StructuredGolden(t *testing.T) {
+	qm := NewQueryManager("testdata/users.golden.yaml", WithParameterized())
+	qm.AddEvent(QueryEvent{
+		SQL:          "UPDATE users SET name='Bob' WHERE id=1",
+		RawSQL:       "UPDATE users SET name=? WHERE id=?",
+		Vars:         []interface{}{"Bob", 1},
+		Operation:    OperationUpdate,
+		Table:        "users",
+		RowsAffected: 1,
+		Caller:       Caller{File: "/src/repo/user.go", Line: 42},
+	})
+
+	// The caller is only written with caller comments
+	expected := "- sql: UPDATE `users` SET `name`=? WHERE `id`=?\n  operation: update\n  table: users\n  args: [Bob, 1]\n  rows_affected: 1\n"
+	content, err := qm.renderGoldenFile(qm.GetEvents())
+	if err != nil || content != expected {
+		t.Errorf("renderGoldenFile() = %q, %v, want %q", content, err, expected)
+	}
+	withCaller := NewQueryManager("testdata/users.golden.yaml", WithParameterized(), WithCallerComments())
+	withCaller.AddEvent(qm.GetEvents()[0])
+	content, err = withCaller.renderGoldenFile(withCaller.GetEvents())
+	if err != nil || content != expected+"  caller: repo/user.go:42\n" {
+		t.Errorf("renderGoldenFile() with caller comments = %q, %v, want the caller", content, err)
+	}
+
+	for _, format := range []GoldenFormat{GoldenFormatYAML, GoldenFormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			content, err := withCaller.renderGoldenAs(format, withCaller.GetEvents())
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := parseGoldenAs(format, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded := withCaller.entryOf(withCaller.GetEvents()[0])
+			if len(entries) != 1 || !reflect.DeepEqual(entries[0], recorded) {
+				t.Errorf("parseGoldenAs() = %+v, want %+v", entries, recorded)
+			}
+		})
+	}
+
+	// Values that cannot be encoded fail instead of being written
+	if content, err := encodeGolden(GoldenFormatJSON, []goldenQuery{{SQL: "SELECT ?", Args: []interface{}{math.NaN()}}}); err == nil {
+		t.Errorf("encodeGolden() = %q, want an error", content)
+	}
+
+	// Semicolons inside string literals do not split entries
+	entries, err := parseGoldenAs(GoldenFormatJSON, `[{"sql": "SELECT * FROM notes WHERE body = 'a;\nb'", "rows_affected": 0}]`)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("parseGoldenAs() = %+v, %v", entries, err)
+	}
+
+	recorded := qm.entryOf(qm.GetEvents()[0])
+	changed := recorded
+	rowsAffected := int64(2)
+	changed.RowsAffected = &rowsAffected
+	changed.Caller = "example/users_test.go:10"
+	if qm.comparisonKey(recorded, assertConfig{}) != qm.comparisonKey(changed, assertConfig{}) {
+		t.Error("metadata should not be compared by default")
+	}
+	config := newAssertConfig([]AssertOption{CompareFields(FieldSQL, FieldRowsAffected)})
+	if qm.comparisonKey(recorded, config) == qm.comparisonKey(changed, config) {
+		t.Error("rows affected should be compared with CompareFields")
+	}
+
+	if GoldenFormatOf("testdata/a.golden.sql") != GoldenFormatSQL || GoldenFormatOf("a.golden.YML") != GoldenFormatYAML || GoldenFormatOf("a.json") != GoldenFormatJSON {
+		t.Error("GoldenFormatOf() should detect the format from the extension")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"separators", "SELECT 1;\nSELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"trailing newline", "SELECT 1;\nSELECT 2;\n", []string{"SELECT 1", "SELECT 2"}},
+		{"CRLF", "SELECT 1;\r\nSELECT 2;\r\n", []string{"SELECT 1", "SELECT 2"}},
+		{"string literal", "INSERT INTO `notes` (`body`) VALUES ('a;\nb');\nSELECT 2;", []string{"INSERT INTO `notes` (`body`) VALUES ('a;\nb')", "SELECT 2"}},
+		{"escaped quotes", "SELECT 'it''s;\n', 'a\\';\n';\nSELECT 2;", []string{"SELECT 'it''s;\n', 'a\\';\n'", "SELECT 2"}},
+		{"backticks", "SELECT `a;\nb` FROM `t`;\nSELECT 2;", []string{"SELECT `a;\nb` FROM `t`", "SELECT 2"}},
+		{"multiple statements in one query", "SELECT 1; SELECT 2;\nSELECT 3;", []string{"SELECT 1; SELECT 2", "SELECT 3"}},
+		{"comments", "-- caller: a.go:1;\nSELECT /* x;\n */ 1;\nSELECT 2;", []string{"-- caller: a.go:1;\nSELECT /* x;\n */ 1", "SELECT 2"}},
+		{"dollar quoting", "SELECT $body$a;\nb$body$, $1;\nSELECT $$c;\n$$;", []string{"SELECT $body$a;\nb$body$, $1", "SELECT $$c;\n$$"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryManager_GoldenRoundTrip(t *testing.T) {
+	qm := NewQueryManager("", WithCallerComments())
+	qm.AddEvent(QueryEvent{SQL: "INSERT INTO `notes` (`body`) VALUES ('first;\nsecond -- not a comment;\n')", Caller: Caller{File: "/repo/notes/notes.go", Line: 7}})
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `notes` WHERE `body` LIKE '%;'"})
+
+	entries := parseGoldenEntries(qm.renderGolden(qm.GetEvents()))
+	if len(entries) != 2 {
+		t.Fatalf("parseGoldenEntries() = %+v, want 2 entries", entries)
+	}
+	for i, event := range qm.GetEvents() {
+		if want := qm.renderGolden([]QueryEvent{event}); entries[i].SQL+";" != want {
+			t.Errorf("entry %d = %q, want %q", i, entries[i].SQL+";", want)
+		}
+		if qm.comparisonKey(entries[i], assertConfig{}) != qm.comparisonKey(qm.entryOf(event), assertConfig{}) {
+			t.Errorf("entry %d should match its recorded query", i)
+		}
+	}
+
+	// MySQL normalization quotes strings holding separators
+	if got, want := qm.GetQueries()[0], "INSERT INTO `notes` (`body`) VALUES (_UTF8MB4'first;\nsecond -- not a comment;\n')"; got != want {
+		t.Errorf("normalize() = %q, want %q", got, want)
+	}
+}
+
+func TestQueryManager_Steps(t *testing.T) {
+	qm := NewQueryManager("")
+	qm.AddQuery("SELECT 1")
+	qm.Step("create order")
+	qm.AddQuery("INSERT INTO orders (id) VALUES (1)")
+	qm.AddQuery("SELECT * FROM orders WHERE id = 1")
+	qm.Step("ship order")
+	qm.AddQuery("UPDATE orders SET shipped = 1 WHERE id = 1")
+
+	expected := "SELECT 1;\n" +
+		"-- step: create order\nINSERT INTO `orders` (`id`) VALUES (1);\n" +
+		"SELECT * FROM `orders` WHERE `id`=1;\n" +
+		"-- step: ship order\nUPDATE `orders` SET `shipped`=1 WHERE `id`=1;"
+	content := qm.renderGolden(qm.GetEvents())
+	if content != expected {
+		t.Errorf("renderGolden() = %q, want %q", content, expected)
+	}
+
+	entries := parseGoldenEntries(content)
+	var steps []string
+	for _, entry := range entries {
+		steps = append(steps, entry.Step)
+	}
+	if want := []string{"", "create order", "create order", "ship order"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("parsed steps = %q, want %q", steps, want)
+	}
+
+	// A query moved to another step no longer matches
+	moved := entries[2]
+	moved.Step = "ship order"
+	if qm.comparisonKey(entries[2], assertConfig{}) == qm.comparisonKey(moved, assertConfig{}) {
+		t.Error("entries in different steps should not match")
+	}
+	if config := newAssertConfig([]AssertOption{CompareFields(FieldSQL)}); qm.comparisonKey(entries[2], config) != qm.comparisonKey(moved, config) {
+		t.Error("steps should not be compared without FieldStep")
+	}
+
+	qm.Clear()
+	qm.AddQuery("SELECT 2")
+	if events := qm.GetEvents(); events[0].Step != "" {
+		t.Errorf("Clear() should end the step, got %q", events[0].Step)
+	}
+}
+
+func TestFormatSQL(t *testing.T) {
+	query := "SELECT `u`.`name`,COUNT(1) FROM `users` AS `u` LEFT JOIN `posts` AS `p` ON `u`.`id`=`p`.`user_id` AND `p`.`draft`=0 " +
+		"WHERE `u`.`age` BETWEEN 20 AND 30 AND (`u`.`a`=1 OR `u`.`b`=2) AND `u`.`id` IN (SELECT `user_id` FROM `orders` WHERE `total`>100) " +
+		"GROUP BY `u`.`name` ORDER BY `u`.`name` DESC,COUNT(1) LIMIT 10"
+	expected := "SELECT `u`.`name`,\n" +
+		"  COUNT(1)\n" +
+		"FROM `users` AS `u`\n" +
+		"LEFT JOIN `posts` AS `p` ON `u`.`id`=`p`.`user_id` AND `p`.`draft`=0\n" +
+		"WHERE `u`.`age` BETWEEN 20 AND 30\n" +
+		"  AND (`u`.`a`=1 OR `u`.`b`=2)\n" +
+		"  AND `u`.`id` IN (\n" +
+		"    SELECT `user_id`\n" +
+		"    FROM `orders`\n" +
+		"    WHERE `total`>100\n" +
+		"  )\n" +
+		"GROUP BY `u`.`name`\n" +
+		"ORDER BY `u`.`name` DESC,\n" +
+		"  COUNT(1)\n" +
+		"LIMIT 10"
+	if got := formatSQL(query); got != expected {
+		t.Errorf("formatSQL() = %q, want %q", got, expected)
+	}
+
+	queries := []string{
+		query,
+		"INSERT INTO `users` (`name`,`email`) VALUES (_UTF8MB4'a;\nb','x'),('c','d') ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)",
+		"UPDATE `users` SET `age`=28,`name`='x' WHERE `id`=1",
+		"DELETE FROM `users` WHERE `users`.`id`=1",
+		"SELECT * FROM (SELECT `a` FROM `t`) AS `x` WHERE EXISTS (SELECT 1 FROM `y`) UNION ALL SELECT * FROM `z`",
+		"SELECT * FROM `users` WHERE `name`=_UTF8MB4John Doe FROM x",
+	}
+	qm := NewQueryManager("")
+	for _, q := range queries {
+		formatted := formatSQL(q)
+		if got := unformatSQL(formatted); got != q {
+			t.Errorf("unformatSQL(formatSQL(%q)) = %q", q, got)
+		}
+		if qm.normalizeForComparison(formatted) != qm.normalizeForComparison(q) {
+			t.Errorf("normalizeForComparison() should ignore formatting of %q", formatted)
+		}
+		if !qm.CompareQueries(formatted, q) {
+			t.Errorf("CompareQueries() should ignore formatting of %q", formatted)
+		}
+	}
+}
+
+func TestDiffQueries(t *testing.T) {
+	expected := []string{
+		"INSERT INTO `users` (`name`) VALUES ('Alice')",
+		"SELECT * FROM `users` WHERE `age`>25",
+		"DELETE FROM `users` WHERE `id`=1",
+	}
+	actual := []string{
+		"SELECT * FROM `flags`",
+		"INSERT INTO `users` (`name`) VALUES ('Alice')",
+		"SELECT * FROM `users` WHERE `age`>30 AND `deleted_at` IS NULL",
+		"DELETE FROM `users` WHERE `id`=1",
+	}
+
+	diffs := diffQueries(expected, actual)
+	want := []queryDiff{
+		{op: diffInsert, expected: -1, actual: 0},
+		{op: diffEqual, expected: 0, actual: 1},
+		{op: diffChange, expected: 1, actual: 2},
+		{op: diffEqual, expected: 2, actual: 3},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("diffQueries() = %+v, want %+v", diffs, want)
+	}
+
+	rendered := renderQueryDiff(diffs, expected, actual, false)
+	wantRendered := "  + [ →1] SELECT * FROM `flags`\n" +
+		"    [1→2] INSERT INTO `users` (`name`) VALUES ('Alice')\n" +
+		"  ~ [2→3] SELECT * FROM `users` WHERE `age`[->25-]{+>30 AND `deleted_at` IS NULL+}\n" +
+		"    [3→4] DELETE FROM `users` WHERE `id`=1\n"
+	if rendered != wantRendered {
+		t.Errorf("renderQueryDiff() = %q, want %q", rendered, wantRendered)
+	}
+	if colored := renderQueryDiff(diffs, expected, actual, true); !strings.Contains(colored, colorGreen+"{+") {
+		t.Errorf("colored renderQueryDiff() should highlight added tokens, got %q", colored)
+	}
+
+	// A missing query is reported once
+	diffs = diffQueries(expected, expected[1:])
+	if len(diffs) != 3 || diffs[0].op != diffDelete || diffs[1].op != diffEqual || diffs[2].op != diffEqual {
+		t.Errorf("diffQueries() = %+v, want the first query deleted", diffs)
+	}
+
+	// Unrelated queries are not paired up as changes
+	diffs = diffQueries(expected[:1], actual[:1])
+	want = []queryDiff{
+		{op: diffDelete, expected: 0, actual: -1},
+		{op: diffInsert, expected: -1, actual: 0},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("diffQueries() = %+v, want %+v", diffs, want)
+	}
+}
+
+func TestQueryManager_Equivalence(t *testing.T) {
+	qm := NewQueryManager("")
+
+	tests := []struct {
+		name      string
+		v1, v2    string
+		v1Applied []string
+		v2Applied []string
+	}{
+		{
+			"introducers and quoting",
+			"SELECT * FROM `requests` WHERE ((`requests`.`status` IN (`in_progress`)) AND (`requests`.`form_id`=_UTF8MB401H799))",
+			"SELECT * FROM `requests` WHERE `requests`.`status` IN ('in_progress') AND `requests`.`form_id`='01H799'",
+			[]string{"introducers", "quoting", "qualifiers", "parentheses"},
+			[]string{"qualifiers"},
+		},
+		{
+			"limit",
+			"SELECT * FROM `users` LIMIT 10,5",
+			"SELECT * FROM `users` LIMIT 5 OFFSET 10",
+			[]string{"limit"},
+			nil,
+		},
+		{
+			"soft delete",
+			"UPDATE `users` SET `deleted_at`='2024-01-01 00:00:00' WHERE `users`.`id`=1 AND `users`.`deleted_at` IS NULL",
+			"UPDATE `users` SET `deleted_at`='2024-06-30 12:00:00' WHERE `users`.`deleted_at` IS NULL AND `users`.`id`=1",
+			[]string{"qualifiers", "soft delete"},
+			[]string{"qualifiers", "soft delete"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v1, v2 := qm.equivalenceOf(tt.v1, GORMv1), qm.equivalenceOf(tt.v2, GORMv2)
+			if v1.key != v2.key {
+				t.Errorf("keys differ:\nv1: %s\nv2: %s", v1.key, v2.key)
+			}
+			if !reflect.DeepEqual(v1.applied, tt.v1Applied) || !reflect.DeepEqual(v2.applied, tt.v2Applied) {
+				t.Errorf("applied v1 %q, v2 %q, want %q, %q", v1.applied, v2.applied, tt.v1Applied, tt.v2Applied)
+			}
+		})
+	}
+
+	// Different values are still different
+	if v1, v2 := qm.equivalenceOf("SELECT * FROM `users` WHERE (`age`>25)", GORMv1), qm.equivalenceOf("SELECT * FROM `users` WHERE `age`>30", GORMv2); v1.key == v2.key {
+		t.Errorf("queries with different values should differ, both are %s", v1.key)
+	}
+
+	differ := []struct {
+		name   string
+		v1, v2 string
+	}{
+		{"soft delete and restore", "UPDATE `users` SET `deleted_at`='2024-01-01 00:00:00' WHERE `id`=1", "UPDATE `users` SET `deleted_at`=NULL WHERE `id`=1"},
+		{"column and string", "SELECT * FROM `products` WHERE `price`='cost'", "SELECT * FROM `products` WHERE `price`=`cost`"},
+		{"column used elsewhere", "SELECT `cost` FROM `products` WHERE `price`=`cost`", "SELECT `cost` FROM `products` WHERE `price`='cost'"},
+	}
+	for _, tt := range differ {
+		t.Run(tt.name, func(t *testing.T) {
+			if v1, v2 := qm.equivalenceOf(tt.v1, GORMv1), qm.equivalenceOf(tt.v2, GORMv2); v1.key == v2.key {
+				t.Errorf("queries should differ, both are %s", v1.key)
+			}
+		})
+	}
+}
+
+func TestQueryManager_AssertEquivalentTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.golden.sql")
+	v1Golden := "SELECT * FROM `users` WHERE (`name`=_UTF8MB4Alice);\nDELETE FROM `users` WHERE `users`.`id`=1;"
+	if err := os.WriteFile(path, []byte(v1Golden), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	qm := NewQueryManager("", WithColor(false))
+	qm.AddQuery("SELECT * FROM `users` WHERE `name`='Alice'")
+	qm.AddQuery("DELETE FROM `users` WHERE `id`=1")
+	recorder := &testutil.FailureRecorder{TB: t}
+	qm.AssertEquivalentTo(recorder, path)
+	if len(recorder.Failures) != 0 {
+		t.Errorf("got failures %q, want none", recorder.Failures)
+	}
+
+	qm.AddQuery("SELECT * FROM `flags`")
+	recorder = &testutil.FailureRecorder{TB: t}
+	qm.AssertEquivalentTo(recorder, path)
+	if len(recorder.Failures) != 1 || len(recorder.Logs) != 1 {
+		t.Fatalf("got failures %q and logs %q, want one of each", recorder.Failures, recorder.Logs)
+	}
+	if !strings.Contains(recorder.Logs[0], "not in the GORM v1 golden file; did not apply:") {
+		t.Errorf("report = %q, want the extra query explained", recorder.Logs[0])
+	}
+}
+
+func TestQueryManager_NormalizeTrace(t *testing.T) {
+	qm := NewQueryManager("")
+	query := "SELECT * FROM `users` WHERE ((`name`=_UTF8MB4Alice) AND (`age`>25)) LIMIT 0,10"
+
+	trace := qm.NormalizeTrace(query)
+	var names []string
+	for i, stage := range trace {
+		names = append(names, stage.Name)
+		if i > 0 && stage.Name != "canonical" && stage.Before != trace[i-1].After {
+			t.Errorf("stage %q starts from %q, want the previous stage's %q", stage.Name, stage.Before, trace[i-1].After)
+		}
+	}
+	wantNames := []string{"comments", "mask", "basicNormalize", "backticks", "charset", "limit", "join order", "where order", "parentheses", "canonical"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("stages = %q, want %q", names, wantNames)
+	}
+	if got, want := trace[len(trace)-2].After, qm.normalizeForComparison(query); got != want {
+		t.Errorf("last string stage = %q, want normalizeForComparison's %q", got, want)
+	}
+	if canonical, _ := qm.canonicalize(query); trace[len(trace)-1].After != canonical {
+		t.Errorf("canonical stage = %q, want %q", trace[len(trace)-1].After, canonical)
+	}
+	if !trace[4].Changed() || !trace[5].Changed() || trace[1].Changed() {
+		t.Errorf("charset and limit stages should change the query and mask should not, got %+v", trace)
+	}
+
+	rendered := qm.renderTraces(query, "SELECT * FROM `users` WHERE `age`>25 AND `name`='Alice' LIMIT 10")
+	for _, want := range []string{"charset:", "limit:", "canonical:", "recorded: SELECT * FROM users WHERE age>25 AND name='Alice' LIMIT 10"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("renderTraces() = %q, want it to contain %q", rendered, want)
+		}
+	}
+	if strings.Contains(rendered, "mask:") {
+		t.Errorf("renderTraces() = %q, want unchanged stages left out", rendered)
+	}
+}
+
+func TestQueryManager_Rules(t *testing.T) {
+	qualifiers := RegexpRule("table qualifiers", "`\\w+`\\.", "")
+	optionalBackticks := RegexpRule("table qualifiers", "`?users`?\\.", "")
+	selectStar := NewRule("select star", func(query string) string {
+		if i := strings.Index(query, " FROM "); strings.HasPrefix(query, "SELECT ") && i != -1 {
+			return "SELECT *" + query[i:]
+		}
+		return query
+	})
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		q1, q2 string
+		equal  bool
+	}{
+		{"qualifiers without rule", nil, "SELECT * FROM `users` WHERE `users`.`id`=1", "SELECT * FROM `users` WHERE `id`=1", false},
+		{"qualifiers with rule", []Option{WithRules(qualifiers)}, "SELECT * FROM `users` WHERE `users`.`id`=1", "SELECT * FROM `users` WHERE `id`=1", true},
+		{"other tables with rule", []Option{WithRules(qualifiers)}, "SELECT * FROM `users` WHERE `users`.`id`=1", "SELECT * FROM `orders` WHERE `id`=1", false},
+		{"columns with rule", []Option{WithRules(selectStar)}, "SELECT `id`,`name` FROM `users`", "SELECT * FROM `users`", true},
+		{"where order", nil, "SELECT * FROM `users` WHERE `a`=1 AND `b`=2", "SELECT * FROM `users` WHERE `b`=2 AND `a`=1", true},
+		{"where order turned off", []Option{WithoutRules(RuleWhereOrder)}, "SELECT * FROM `users` WHERE `a`=1 AND `b`=2", "SELECT * FROM `users` WHERE `b`=2 AND `a`=1", false},
+		{"limit turned off", []Option{WithoutRules(RuleLimit)}, "SELECT * FROM `users` LIMIT 10 OFFSET 0", "SELECT * FROM `users` LIMIT 10", false},
+		{"unparseable where order turned off", []Option{WithoutRules(RuleWhereOrder)}, "SELECT * FROM users WHERE a=1 AND b=2 LIMIT ALL", "SELECT * FROM users WHERE b=2 AND a=1 LIMIT ALL", false},
+		{"unparseable where order", nil, "SELECT * FROM users WHERE a=1 AND b=2 LIMIT ALL", "SELECT * FROM users WHERE b=2 AND a=1 LIMIT ALL", true},
+		// Queries that cannot be parsed reach rules in their string form, without backticks
+		{"unparseable qualifiers with rule", []Option{WithRules(qualifiers)}, "SELECT * FROM `users` WHERE `users`.`id`=1 LIMIT ALL", "SELECT * FROM `users` WHERE `id`=1 LIMIT ALL", false},
+		{"qualifiers with optional backticks", []Option{WithRules(optionalBackticks)}, "SELECT * FROM `users` WHERE `users`.`id`=1", "SELECT * FROM `users` WHERE `id`=1", true},
+		{"unparseable qualifiers with optional backticks", []Option{WithRules(optionalBackticks)}, "SELECT * FROM `users` WHERE `users`.`id`=1 LIMIT ALL", "SELECT * FROM `users` WHERE `id`=1 LIMIT ALL", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := NewQueryManager("", tt.opts...)
+			if equal, n1, n2 := qm.CompareQueriesDebug(tt.q1, tt.q2); equal != tt.equal {
+				t.Errorf("CompareQueries() = %v, want %v\n%s\n%s", equal, tt.equal, n1, n2)
+			}
+		})
+	}
+
+	qm := NewQueryManager("")
+	qm.AddRule(qualifiers)
+	if !qm.CompareQueries("SELECT * FROM `users` WHERE `users`.`id`=1", "SELECT * FROM `users` WHERE `id`=1") {
+		t.Error("rules added with AddRule should be applied")
+	}
+	trace := qm.NormalizeTrace("SELECT * FROM `users` WHERE `users`.`id`=1")
+	if last := trace[len(trace)-1]; last.Name != "table qualifiers" || last.After != "SELECT * FROM `users` WHERE `id`=1" {
+		t.Errorf("last stage = %+v, want the table qualifiers rule applied to the canonical form", last)
+	}
+
+	// Unknown rule names fail the golden assertions
+	unknown := NewQueryManager("rules.golden.sql", WithoutRules(RuleWhereOrder, "where-order"))
+	recorder := &testutil.FailureRecorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		unknown.AssertGolden(recorder)
+	}()
+	<-done
+	if len(recorder.Failures) != 1 || !strings.Contains(recorder.Failures[0], `"where-order"`) {
+		t.Errorf("failures = %q, want the unknown rule name reported", recorder.Failures)
+	}
+}
+
+func TestQueryManager_InLists(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		q1, q2 string
+		equal  bool
+	}{
+		{"order", nil, "SELECT * FROM `users` WHERE `id` IN (1,2)", "SELECT * FROM `users` WHERE `id` IN (2,1)", true},
+		{"strings", nil, "SELECT * FROM `users` WHERE `name` IN ('b','a')", "SELECT * FROM `users` WHERE `name` IN (_UTF8MB4'a',_UTF8MB4'b')", true},
+		{"duplicates", nil, "SELECT * FROM `users` WHERE `id` IN (1,2,1)", "SELECT * FROM `users` WHERE `id` IN (2,1)", true},
+		{"different values", nil, "SELECT * FROM `users` WHERE `id` IN (1,2)", "SELECT * FROM `users` WHERE `id` IN (1,3)", false},
+		{"nested in conditions", nil, "SELECT * FROM `users` WHERE (`a`=1 OR `id` IN (3,2)) AND `b`=2", "SELECT * FROM `users` WHERE `b`=2 AND (`id` IN (2,3) OR `a`=1)", true},
+		{"placeholders", nil, "SELECT * FROM `users` WHERE `id` IN (?,?)", "SELECT * FROM `users` WHERE `id` IN (?)", false},
+		{"order turned off", []Option{WithoutRules(RuleInListOrder)}, "SELECT * FROM `users` WHERE `id` IN (1,2)", "SELECT * FROM `users` WHERE `id` IN (2,1)", false},
+		{"single value", nil, "SELECT * FROM `users` WHERE `id` IN (1)", "SELECT * FROM `users` WHERE `id`=1", true},
+		{"single value NOT IN", nil, "SELECT * FROM `users` WHERE `id` NOT IN (1)", "SELECT * FROM `users` WHERE `id`!=1", true},
+		{"single duplicated value", nil, "SELECT * FROM `users` WHERE `id` IN (1,1)", "SELECT * FROM `users` WHERE `id`=1", true},
+		{"single value of several", nil, "SELECT * FROM `users` WHERE `id` IN (1,2)", "SELECT * FROM `users` WHERE `id`=1", false},
+		{"single value turned off", []Option{WithoutRules(RuleSingleIn)}, "SELECT * FROM `users` WHERE `id` IN (1)", "SELECT * FROM `users` WHERE `id`=1", false},
+		{"subquery", nil, "SELECT * FROM `users` WHERE `id` IN (SELECT `user_id` FROM `orders`)", "SELECT * FROM `users` WHERE `id`=(SELECT `user_id` FROM `orders`)", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := NewQueryManager("", tt.opts...)
+			if equal, n1, n2 := qm.CompareQueriesDebug(tt.q1, tt.q2); equal != tt.equal {
+				t.Errorf("CompareQueries() = %v, want %v\n%s\n%s", equal, tt.equal, n1, n2)
+			}
+		})
+	}
+}
+
+func TestUpdateModeFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  string
+		run     string
+		test    string
+		want    UpdateMode
+		wantErr bool
+	}{
+		{"unset", "", "", "TestUser", UpdateNone, false},
+		{"missing", "missing", "", "TestUser", UpdateMissing, false},
+		{"case insensitive", "FAILED", "", "TestUser", UpdateFailed, false},
+		{"matching test", "all", "TestUser*", "TestUserCreate", UpdateAll, false},
+		{"matching parent test", "all", "TestUser*", "TestUserCreate/admin", UpdateAll, false},
+		{"matching subtest", "all", "TestUser/ad*", "TestUser/admin", UpdateAll, false},
+		{"other test", "all", "TestUser*", "TestOrder", UpdateNone, false},
+		{"invalid mode", "some", "", "TestUser", UpdateNone, true},
+		{"invalid glob", "all", "TestUser[", "TestUser", UpdateNone, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(UpdateEnv, tt.update)
+			t.Setenv(UpdateRunEnv, tt.run)
+			got, err := updateModeFor(tt.test)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("updateModeFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("updateModeFor() = %q, want %q", got, tt.want)
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestQueryManager_UpdateModes(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	qm := NewQueryManager("update.golden.sql", WithDialect(DialectSQLite))
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `id`=1"})
+	goldenPath := filepath.Join("testdata", "update.golden.sql")
+	read := func() string {
+		data, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Setenv(UpdateEnv, string(UpdateMissing))
+	qm.AssertGolden(t)
+	created := read()
+	if !strings.Contains(created, "SELECT * FROM `users` WHERE `id`=1") {
+		t.Fatalf("missing golden file = %q, want it created with the recorded queries", created)
+	}
+
+	// Golden files that exist are compared, not rewritten
+	formatted := "select * from users where id = 1;\n"
+	if err := os.WriteFile(goldenPath, []byte(formatted), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	qm.AssertGolden(t)
+	if got := read(); got != formatted {
+		t.Errorf("golden file = %q, want it left as %q", got, formatted)
+	}
+
+	t.Setenv(UpdateEnv, string(UpdateFailed))
+	qm.AssertGoldenSorted(t)
+	if got := read(); got != formatted {
+		t.Errorf("matching golden file = %q, want it left as %q", got, formatted)
+	}
+	if err := os.WriteFile(goldenPath, []byte("SELECT * FROM `users` WHERE `id`=2;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	qm.AssertGolden(t)
+	if got := read(); got != created {
+		t.Errorf("failed golden file = %q, want it rewritten as %q", got, created)
+	}
+
+	// Only the golden files of the selected tests are updated
+	t.Setenv(UpdateEnv, string(UpdateAll))
+	t.Setenv(UpdateRunEnv, "TestOther")
+	if err := os.WriteFile(goldenPath, []byte(formatted), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	qm.AssertContainsGolden(t)
+	if got := read(); got != formatted {
+		t.Errorf("golden file of another test = %q, want it left as %q", got, formatted)
+	}
+}
+
+func TestQueryManager_UpdateKeepsMatchingQueries(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	qm := NewQueryManager("keep.golden.sql", WithDialect(DialectSQLite))
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `name`='Alice' LIMIT 1"})
+	qm.AddEvent(QueryEvent{SQL: "UPDATE `users` SET `age`=31 WHERE `id`=1", Step: "update"})
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `id`=1", Step: "update"})
+	goldenPath := filepath.Join("testdata", "keep.golden.sql")
+	if err := os.MkdirAll("testdata", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		data, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Golden files matching through wildcards are not rewritten, even by -update
+	golden := "select * from users where name = '<ANY>' limit 1;\n" +
+		"-- step: update\nUPDATE `users` SET `age`=<ANY> WHERE `id`=1;\n" +
+		"SELECT * FROM `users` WHERE `id`=1;\n"
+	for _, mode := range []UpdateMode{UpdateFailed, UpdateAll} {
+		if err := os.WriteFile(goldenPath, []byte(golden), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(UpdateEnv, string(mode))
+		qm.AssertGolden(t)
+		qm.AssertGoldenSorted(t)
+		if got := read(); got != golden {
+			t.Errorf("%s matching golden file = %q, want it left as %q", mode, got, golden)
+		}
+	}
+
+	// Only the queries that differ are rewritten
+	if err := os.WriteFile(goldenPath, []byte("select * from users where name = '<ANY>' limit 1;\n"+
+		"-- step: update\nUPDATE `users` SET `age`=<ANY> WHERE `id`=2;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(UpdateEnv, string(UpdateAll))
+	qm.AssertGolden(t)
+	want := "select * from users where name = '<ANY>' limit 1;\n" +
+		"-- step: update\nUPDATE `users` SET `age`=31 WHERE `id`=1;\n" +
+		"SELECT * FROM `users` WHERE `id`=1;"
+	if got := read(); got != want {
+		t.Errorf("failed golden file = %q, want %q", got, want)
+	}
+	t.Setenv(UpdateEnv, string(UpdateNone))
+	qm.AssertGolden(t)
+}
+
+func TestQueryManager_UpdateShapeOnly(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.MkdirAll("testdata", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	qm := NewQueryManager("shape.golden.sql", WithDialect(DialectSQLite), WithParameterized())
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `age`>41", RawSQL: "SELECT * FROM `users` WHERE `age`>?", Vars: []interface{}{41}})
+	qm.AddEvent(QueryEvent{SQL: "DELETE FROM `users` WHERE `id`=7", RawSQL: "DELETE FROM `users` WHERE `id`=?", Vars: []interface{}{7}})
+	goldenPath := filepath.Join("testdata", "shape.golden.sql")
+
+	// A shape-only update keeps the args of the queries whose shape matches
+	golden := "-- args: [25]\nSELECT * FROM `users` WHERE `age`>?;\n" +
+		"-- args: [3]\nDELETE FROM `orders` WHERE `id`=?;\n"
+	if err := os.WriteFile(goldenPath, []byte(golden), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(UpdateEnv, string(UpdateAll))
+	qm.AssertGolden(t, ShapeOnly())
+	data, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- args: [25]\nSELECT * FROM `users` WHERE `age`>?;\n" +
+		"-- args: [7]\nDELETE FROM `users` WHERE `id`=?;"
+	if got := string(data); got != want {
+		t.Errorf("shape-only golden file = %q, want %q", got, want)
+	}
+}
+
+func TestQueryManager_UpdatePartialGolden(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	qm := NewQueryManager("partial.golden.sql", WithDialect(DialectSQLite))
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `flags` WHERE `name`='beta'"})
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `users` WHERE `id`=1"})
+	qm.AddEvent(QueryEvent{SQL: "INSERT INTO `orders` (`user_id`,`total`) VALUES (1,10)", Step: "checkout"})
+	qm.AddEvent(QueryEvent{SQL: "SELECT * FROM `flags` WHERE `name`='audit'", Step: "checkout"})
+	goldenPath := filepath.Join("testdata", "partial.golden.sql")
+	read := func() string {
+		data, err := os.ReadFile(goldenPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// A missing golden file holds every recorded query, to be trimmed by hand
+	t.Setenv(UpdateEnv, string(UpdateMissing))
+	qm.AssertContainsGolden(t)
+	if got := read(); !strings.Contains(got, "`name`='beta'") || !strings.Contains(got, "`name`='audit'") {
+		t.Fatalf("missing golden file = %q, want it created with all recorded queries", got)
+	}
+
+	// Golden queries no longer recorded are replaced, the others are kept and no query is added
+	golden := "select * from users where id = 1;\n" +
+		"-- step: checkout\nINSERT INTO `orders` (`user_id`) VALUES (1);\n" +
+		"DELETE FROM `sessions` WHERE `user_id`=1;\n"
+	want := "select * from users where id = 1;\n" +
+		"-- step: checkout\nINSERT INTO `orders` (`user_id`,`total`) VALUES (1,10);"
+	for _, mode := range []UpdateMode{UpdateFailed, UpdateAll} {
+		for _, assert := range []func(testing.TB, ...AssertOption){qm.AssertContainsGolden, qm.AssertSubsetGolden} {
+			if err := os.WriteFile(goldenPath, []byte(golden), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(UpdateEnv, string(mode))
+			assert(t)
+			if got := read(); got != want {
+				t.Errorf("%s golden file = %q, want %q", mode, got, want)
+			}
+
+			t.Setenv(UpdateEnv, string(UpdateNone))
+			assert(t)
+		}
+	}
+
+	// Assertions that only compare fail without rewriting the golden file
+	if err := os.WriteFile(goldenPath, []byte(golden), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(UpdateEnv, string(UpdateAll))
+	recorder := &testutil.FailureRecorder{TB: t}
+	qm.AssertContainsGolden(recorder, CompareOnly())
+	if len(recorder.Failures) != 1 {
+		t.Errorf("compare-only failures = %q, want 1", recorder.Failures)
+	}
+	if got := read(); got != golden {
+		t.Errorf("compare-only golden file = %q, want it left as %q", got, golden)
+	}
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Verbosity controls when assertions log the normalized comparison of matching queries.
+// Mismatches are always logged.
+type Verbosity int
+
+const (
+	// VerbosityAuto logs the comparison of matching queries only when tests run with -v
+	VerbosityAuto Verbosity = iota
+	// VerbosityQuiet never logs the comparison of matching queries
+	VerbosityQuiet
+	// VerbosityVerbose always logs the comparison of matching queries, so it is shown with -v
+	// and when the test fails later on
+	VerbosityVerbose
+)
+
+// ansiPattern matches the ANSI color codes removed from reports written without colors
+var ansiPattern = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// report collects the output of an assertion and writes it to the test log as one entry
+type report struct {
+	b       strings.Builder
+	colored bool
+}
+
+func (qm *QueryManager) newReport() *report {
+	return &report{colored: qm.colored()}
+}
+
+// printf adds formatted output to the report
+func (r *report) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&r.b, format, args...)
+}
+
+// queries lists queries with their sequence numbers
+func (r *report) queries(events []QueryEvent) {
+	for _, event := range events {
+		r.printf("     %s[%d]%s %s\n", colorBlue, event.Sequence, colorReset, event.SQL)
+	}
+}
+
+// log writes the report to the test log, without colors unless they are enabled
+func (r *report) log(t testing.TB) {
+	t.Helper()
+	out := strings.TrimRight(r.b.String(), "\n")
+	if out == "" {
+		return
+	}
+	if !r.colored {
+		out = ansiPattern.ReplaceAllString(out, "")
+	}
+	t.Log(out)
+}
+
+// colored reports whether output is colored: as set by WithColor, otherwise unless
+// NO_COLOR is set, TERM is "dumb" or stdout is not a terminal
+func (qm *QueryManager) colored() bool {
+	if qm.color != nil {
+		return *qm.color
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// showMatches reports whether the comparison of matching queries is logged
+func (qm *QueryManager) showMatches() bool {
+	switch qm.verbosity {
+	case VerbosityQuiet:
+		return false
+	case VerbosityVerbose:
+		return true
+	default:
+		return testing.Verbose()
+	}
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"regexp"
+	"testing"
+)
+
+// RuleName names a built-in normalization rule
+type RuleName string
+
+// Names of the built-in normalization rules, which can be turned off with WithoutRules
+const (
+	// RuleLimit compares LIMIT offset,count as LIMIT count OFFSET offset and drops OFFSET 0
+	RuleLimit RuleName = "limit"
+	// RuleJoinOrder compares adjacent INNER JOINs in any order their ON clauses allow
+	RuleJoinOrder RuleName = "join order"
+	// RuleWhereOrder compares the conditions of WHERE clauses in any order
+	RuleWhereOrder RuleName = "where order"
+	// RuleInListOrder compares the values of IN lists as a set, in any order and without duplicates,
+	// and the args bound to IN lists of placeholders in any order.
+	// It rewrites the AST, so it only applies to queries that can be parsed, as does RuleSingleIn.
+	RuleInListOrder RuleName = "in list order"
+	// RuleSingleIn compares col IN (x) as col=x and col NOT IN (x) as col!=x
+	RuleSingleIn RuleName = "single in"
+)
+
+// builtinRules are the names WithoutRules accepts
+var builtinRules = []RuleName{RuleLimit, RuleJoinOrder, RuleWhereOrder, RuleInListOrder, RuleSingleIn}
+
+func isBuiltinRule(name RuleName) bool {
+	for _, rule := range builtinRules {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizationRule rewrites queries before they are compared, so variations a team considers
+// harmless compare equal. Rules receive the canonical form of queries that can be parsed,
+// e.g. SELECT * FROM `users` WHERE `id` IN (1,2), which is the form shown in golden diffs, and
+// the string form of normalizeForComparison, without backticks, otherwise.
+type NormalizationRule interface {
+	// Name identifies the rule in normalization traces
+	Name() string
+	// Normalize rewrites a query
+	Normalize(query string) string
+}
+
+// ruleFunc is a NormalizationRule calling a function
+type ruleFunc struct {
+	name      string
+	normalize func(query string) string
+}
+
+func (r ruleFunc) Name() string {
+	return r.name
+}
+
+func (r ruleFunc) Normalize(query string) string {
+	return r.normalize(query)
+}
+
+// NewRule returns a NormalizationRule named name that rewrites queries with normalize
+func NewRule(name string, normalize func(query string) string) NormalizationRule {
+	return ruleFunc{name: name, normalize: normalize}
+}
+
+// RegexpRule returns a NormalizationRule replacing every match of pattern with replacement,
+// which may refer to submatches as in regexp.ReplaceAllString,
+// e.g. RegexpRule("table qualifiers", "`\\w+`\\.", "").
+// As described on NormalizationRule, queries that cannot be parsed reach the rule without
+// backticks, so a pattern matching identifiers in both forms makes them optional: "`?\\w+`?\\.".
+func RegexpRule(name, pattern, replacement string) NormalizationRule {
+	re := regexp.MustCompile(pattern)
+	return NewRule(name, func(query string) string {
+		return re.ReplaceAllString(query, replacement)
+	})
+}
+
+// AddRule adds normalization rules, applied after the built-in rules in the order they are added.
+// It is not safe for concurrent use: add rules before queries are recorded and asserted.
+func (qm *QueryManager) AddRule(rules ...NormalizationRule) {
+	qm.rules = append(qm.rules, rules...)
+}
+
+// checkRules fails the test when WithoutRules was given names that are not built-in rules
+func (qm *QueryManager) checkRules(t testing.TB) {
+	t.Helper()
+	if len(qm.unknownRules) > 0 {
+		t.Fatalf("unknown normalization rules %q passed to WithoutRules, want one of %q", qm.unknownRules, builtinRules)
+	}
+}
+
+// normalizationRules returns the built-in rules that are not turned off, followed by the added rules
+func (qm *QueryManager) normalizationRules() []NormalizationRule {
+	builtin := []NormalizationRule{
+		NewRule(string(RuleLimit), qm.normalizeLimitClause),
+		NewRule(string(RuleJoinOrder), qm.normalizeJoinOrder),
+		NewRule(string(RuleWhereOrder), qm.normalizeMainWhereClause),
+	}
+	var rules []NormalizationRule
+	for _, rule := range builtin {
+		if !qm.disabledRules[RuleName(rule.Name())] {
+			rules = append(rules, rule)
+		}
+	}
+	return append(rules, qm.rules...)
+}
+
+// applyRules applies the added rules to the canonical form of a query
+func (qm *QueryManager) applyRules(canonical string) string {
+	for _, rule := range qm.rules {
+		canonical = rule.Normalize(canonical)
+	}
+	return canonical
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"strings"
+)
+
+// NormalizeStage is a stage of query normalization with the query before and after it
+type NormalizeStage struct {
+	// Name is one of "comments", "mask", "basicNormalize", "backticks", "charset", the name of a
+	// NormalizationRule and "parentheses", or "canonical" for the AST form
+	Name   string
+	Before string
+	After  string
+}
+
+// Changed reports whether the stage changed the query
+func (s NormalizeStage) Changed() bool {
+	return s.Before != s.After
+}
+
+// NormalizeTrace returns each stage of the string normalization queries are compared with
+// when they cannot be parsed, with the query before and after it. When the query can be parsed
+// the trace ends with a "canonical" stage holding the AST form queries are compared in instead,
+// and the rules added with AddRule applied to it, so it shows why two queries that look
+// identical were not considered equal.
+func (qm *QueryManager) NormalizeTrace(query string) []NormalizeStage {
+	var stages []NormalizeStage
+	current := query
+	for _, stage := range qm.normalizeStages() {
+		next := stage.apply(current)
+		stages = append(stages, NormalizeStage{Name: stage.name, Before: current, After: next})
+		current = next
+	}
+	if canonical, ok := qm.canonicalize(query); ok {
+		stages = append(stages, NormalizeStage{Name: "canonical", Before: query, After: canonical})
+		for _, rule := range qm.rules {
+			next := rule.Normalize(canonical)
+			stages = append(stages, NormalizeStage{Name: rule.Name(), Before: canonical, After: next})
+			canonical = next
+		}
+	}
+	return stages
+}
+
+// renderTraces renders the normalization traces of a golden and a recorded query side by side,
+// listing only the stages that changed either query
+func (qm *QueryManager) renderTraces(golden, recorded string) string {
+	goldenTrace, recordedTrace := qm.NormalizeTrace(golden), qm.NormalizeTrace(recorded)
+
+	var b strings.Builder
+	for i := range goldenTrace {
+		g := goldenTrace[i]
+		var r NormalizeStage
+		if i < len(recordedTrace) {
+			r = recordedTrace[i]
+		}
+		if !g.Changed() && !r.Changed() {
+			continue
+		}
+		b.WriteString("      " + colorCyan + g.Name + ":" + colorReset + "\n")
+		b.WriteString("        golden:   " + g.After + "\n")
+		if r.Name == g.Name {
+			b.WriteString("        recorded: " + r.After + "\n")
+		}
+	}
+	// Only the recorded query can be parsed
+	for _, r := range recordedTrace[min(len(goldenTrace), len(recordedTrace)):] {
+		if r.Changed() {
+			b.WriteString("      " + colorCyan + r.Name + ":" + colorReset + "\n")
+			b.WriteString("        recorded: " + r.After + "\n")
+		}
+	}
+	return b.String()
+}
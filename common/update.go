@@ -0,0 +1,178 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/golden"
+)
+
+// UpdateMode selects which golden files assertions rewrite with the recorded queries
+type UpdateMode string
+
+const (
+	// UpdateNone compares against golden files without rewriting them
+	UpdateNone UpdateMode = "none"
+	// UpdateMissing creates golden files that do not exist and compares against the others
+	UpdateMissing UpdateMode = "missing"
+	// UpdateFailed creates missing golden files and rewrites the queries of the others
+	// the recorded queries do not match, keeping the matching ones as written
+	UpdateFailed UpdateMode = "failed"
+	// UpdateAll updates golden files as UpdateFailed does, and is the mode -update selects
+	UpdateAll UpdateMode = "all"
+)
+
+// Environment variables selecting the update mode and the tests it applies to
+const (
+	UpdateEnv    = "GORMGOLDEN_UPDATE"
+	UpdateRunEnv = "GORMGOLDEN_UPDATE_RUN"
+)
+
+var (
+	flagUpdate    = flag.String("gormgolden.update", "", "update mode of gormgolden golden files: all, missing, failed or none (default $"+UpdateEnv+")")
+	flagUpdateRun = flag.String("gormgolden.update-run", "", "glob of the test names gormgolden updates golden files for (default $"+UpdateRunEnv+")")
+)
+
+// updateModeFor returns the update mode of the test named name. -update selects UpdateAll,
+// otherwise -gormgolden.update or GORMGOLDEN_UPDATE does, for the tests matching
+// -gormgolden.update-run or GORMGOLDEN_UPDATE_RUN when one is set.
+func updateModeFor(name string) (UpdateMode, error) {
+	if golden.FlagUpdate() {
+		return UpdateAll, nil
+	}
+
+	value := *flagUpdate
+	if value == "" {
+		value = os.Getenv(UpdateEnv)
+	}
+	mode := UpdateMode(strings.ToLower(strings.TrimSpace(value)))
+	switch mode {
+	case "", UpdateNone:
+		return UpdateNone, nil
+	case UpdateMissing, UpdateFailed, UpdateAll:
+	default:
+		return UpdateNone, fmt.Errorf("invalid %s %q: want all, missing, failed or none", UpdateEnv, value)
+	}
+
+	pattern := *flagUpdateRun
+	if pattern == "" {
+		pattern = os.Getenv(UpdateRunEnv)
+	}
+	if pattern == "" {
+		return mode, nil
+	}
+	matched, err := matchTestName(pattern, name)
+	if err != nil {
+		return UpdateNone, fmt.Errorf("invalid %s %q: %w", UpdateRunEnv, pattern, err)
+	}
+	if !matched {
+		return UpdateNone, nil
+	}
+	return mode, nil
+}
+
+// matchTestName reports whether pattern matches the test name or one of its parents,
+// so TestUser* selects the subtests of TestUserCreate too
+func matchTestName(pattern, name string) (bool, error) {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		matched, err := path.Match(pattern, strings.Join(parts[:i+1], "/"))
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// updateMode returns the update mode of t, failing it when the mode is invalid
+func updateMode(t testing.TB) UpdateMode {
+	t.Helper()
+	mode, err := updateModeFor(t.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return mode
+}
+
+// updateMode returns the update mode of t, UpdateNone when the assertion only compares
+func (c assertConfig) updateMode(t testing.TB) UpdateMode {
+	t.Helper()
+	if c.compareOnly {
+		return UpdateNone
+	}
+	return updateMode(t)
+}
+
+// assertGolden asserts content against the golden file filename in testdata. golden.Assert
+// rewrites it under -update, so assertions that only compare fail instead.
+func (c assertConfig) assertGolden(t testing.TB, content, filename string) {
+	t.Helper()
+	if c.compareOnly && golden.FlagUpdate() {
+		t.Errorf("recorded queries do not match golden file '%s'", filepath.Join("testdata", filename))
+		return
+	}
+	golden.Assert(t, content, filename)
+}
+
+// writeGolden writes a golden file with the recorded queries
+func writeGolden(t testing.TB, goldenPath, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+		t.Fatalf("failed to create directory of golden file '%s': %v", goldenPath, err)
+	}
+	if err := os.WriteFile(goldenPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write golden file '%s': %v", goldenPath, err)
+	}
+	t.Logf("updated golden file '%s'", goldenPath)
+}
+
+// goldenUpdate is an entry of an updated golden file: a golden entry kept as written,
+// or else a recorded query
+type goldenUpdate struct {
+	entry *goldenEntry
+	event QueryEvent
+}
+
+// renderGoldenUpdate renders the entries of an updated golden file in its format.
+// The step headers of kept entries are dropped and written again above the first
+// query of each step, so replaced and removed queries do not leave them out of place.
+func (qm *QueryManager) renderGoldenUpdate(updates []goldenUpdate) (string, error) {
+	format := GoldenFormatOf(qm.goldenFile)
+	if format != GoldenFormatSQL {
+		queries := make([]goldenQuery, len(updates))
+		for i, update := range updates {
+			if update.entry != nil {
+				queries[i] = update.entry.query()
+			} else {
+				queries[i] = qm.goldenQueryOf(update.event)
+			}
+		}
+		return encodeGolden(format, queries)
+	}
+
+	entries := make([]string, len(updates))
+	step := ""
+	for i, update := range updates {
+		query, queryStep := "", update.event.Step
+		if update.entry != nil {
+			query = strings.Replace(update.entry.SQL, stepHeaderOf(update.entry.SQL), "", 1)
+			queryStep = update.entry.Step
+		} else {
+			query = qm.renderQuery(update.event)
+		}
+		if queryStep != step {
+			query = stepCommentPrefix + queryStep + "\n" + query
+			step = queryStep
+		}
+		entries[i] = query
+	}
+	if len(entries) == 0 {
+		return "", nil
+	}
+	return strings.Join(entries, ";\n") + ";", nil
+}
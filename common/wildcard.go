@@ -0,0 +1,270 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/tidb/parser/opcode"
+)
+
+// Wildcards golden queries may contain in place of values
+const (
+	// AnyWildcard matches a single value: a literal, a column, an expression or a subquery,
+	// e.g. SELECT * FROM `users` WHERE `id`=<ANY>, or the count or offset of LIMIT
+	AnyWildcard = "<ANY>"
+	// ListWildcard matches a non-empty list of values or a subquery,
+	// e.g. SELECT * FROM `users` WHERE `id` IN (<LIST>)
+	ListWildcard = "<LIST>"
+)
+
+// Wildcards are replaced by identifiers the parser accepts before golden queries are
+// canonicalized, and restored afterwards
+var wildcardSentinels = []struct{ wildcard, sentinel string }{
+	{AnyWildcard, "__gormgolden_any__"},
+	{ListWildcard, "__gormgolden_list__"},
+}
+
+// numberSentinel replaces <ANY> where only a number is allowed, as the count and
+// offset of LIMIT, since an identifier there would not parse
+const numberSentinel = "987654321987654321"
+
+// numberWildcardPattern matches <ANY> as a LIMIT count or offset, e.g. LIMIT <ANY>,
+// LIMIT 10 OFFSET <ANY> or LIMIT <ANY>,<ANY>
+var numberWildcardPattern = regexp.MustCompile(`(?i)(\b(?:LIMIT|OFFSET)\s+(?:\w+\s*,\s*)?)` + regexp.QuoteMeta(AnyWildcard))
+
+// replaceWildcards replaces the wildcards in a golden query with sentinel identifiers,
+// or with numberSentinel where only a number is allowed
+func replaceWildcards(query string) string {
+	if !strings.Contains(query, "<") {
+		return query
+	}
+	for numberWildcardPattern.MatchString(query) {
+		query = numberWildcardPattern.ReplaceAllString(query, "${1}"+numberSentinel)
+	}
+	for _, w := range wildcardSentinels {
+		identifier := "`" + w.sentinel + "`"
+		query = strings.ReplaceAll(query, "'"+w.wildcard+"'", identifier)
+		query = strings.ReplaceAll(query, `"`+w.wildcard+`"`, identifier)
+		query = strings.ReplaceAll(query, w.wildcard, identifier)
+	}
+	return query
+}
+
+// Sets of AND and OR operands a golden query holds in any order, see sortLogicOperands,
+// e.g. <AND>(`a`=<ANY>, `a`=1) matches `a`=1 AND `a`='x' and `a`='x' AND `a`=1
+const (
+	andSetPrefix = "<AND>("
+	orSetPrefix  = "<OR>("
+)
+
+// restoreWildcards turns sentinel identifiers in a comparison key back into wildcards
+func restoreWildcards(key string) string {
+	key = strings.ReplaceAll(key, numberSentinel, AnyWildcard)
+	if !strings.Contains(key, "__gormgolden_") {
+		return key
+	}
+	for _, w := range wildcardSentinels {
+		key = strings.ReplaceAll(key, "`"+w.sentinel+"`", w.wildcard)
+		key = strings.ReplaceAll(key, w.sentinel, w.wildcard)
+	}
+	key = strings.ReplaceAll(key, strings.ToUpper(logicSetNames[opcode.LogicAnd])+"(", andSetPrefix)
+	key = strings.ReplaceAll(key, strings.ToUpper(logicSetNames[opcode.LogicOr])+"(", orSetPrefix)
+	return key
+}
+
+// keysMatch reports whether a recorded comparison key matches a golden one,
+// which may contain wildcards
+func keysMatch(golden, actual string) bool {
+	if !hasWildcard(golden) {
+		return golden == actual
+	}
+	if matchPattern(parsePattern(golden), actual) {
+		return true
+	}
+	// A list of one value is compared as a comparison with it, see RuleSingleIn
+	if strings.Contains(golden, " IN ("+ListWildcard+")") {
+		single := strings.ReplaceAll(golden, " NOT IN ("+ListWildcard+")", "!="+AnyWildcard)
+		single = strings.ReplaceAll(single, " IN ("+ListWildcard+")", "="+AnyWildcard)
+		return matchPattern(parsePattern(single), actual)
+	}
+	return false
+}
+
+func hasWildcard(key string) bool {
+	return strings.Contains(key, AnyWildcard) || strings.Contains(key, ListWildcard)
+}
+
+type patternKind int
+
+const (
+	patternLiteral patternKind = iota
+	patternAny
+	patternList
+	patternSet
+)
+
+type patternToken struct {
+	kind patternKind
+	// text is the literal text, or the operator joining the members of a set
+	text string
+	// members are the operands of a set, matched in any order
+	members [][]patternToken
+}
+
+// parsePattern splits a golden key into literal text and wildcards.
+// A quoted "<ANY>", as written in args, is a wildcard for the whole JSON value.
+func parsePattern(key string) []patternToken {
+	var tokens []patternToken
+	for key != "" {
+		i := strings.Index(key, "<")
+		if i == -1 {
+			tokens = append(tokens, patternToken{kind: patternLiteral, text: key})
+			break
+		}
+
+		rest := key[i:]
+		if separator, members, length, ok := parseSet(rest); ok {
+			if key[:i] != "" {
+				tokens = append(tokens, patternToken{kind: patternLiteral, text: key[:i]})
+			}
+			tokens = append(tokens, patternToken{kind: patternSet, text: separator, members: members})
+			key = rest[length:]
+			continue
+		}
+		kind, length := patternLiteral, 0
+		switch {
+		case strings.HasPrefix(rest, AnyWildcard):
+			kind, length = patternAny, len(AnyWildcard)
+		case strings.HasPrefix(rest, ListWildcard):
+			kind, length = patternList, len(ListWildcard)
+		}
+		if kind == patternLiteral {
+			tokens = append(tokens, patternToken{kind: patternLiteral, text: key[:i+1]})
+			key = key[i+1:]
+			continue
+		}
+
+		literal := key[:i]
+		if strings.HasSuffix(literal, `"`) && strings.HasPrefix(key[i+length:], `"`) {
+			literal = literal[:len(literal)-1]
+			length++
+		}
+		if literal != "" {
+			tokens = append(tokens, patternToken{kind: patternLiteral, text: literal})
+		}
+		tokens = append(tokens, patternToken{kind: kind})
+		key = key[i+length:]
+	}
+	return tokens
+}
+
+// parseSet parses the set of operands at the start of key, returning the operator joining
+// them, their patterns and the length of the set
+func parseSet(key string) (string, [][]patternToken, int, bool) {
+	separator := ""
+	switch {
+	case strings.HasPrefix(key, andSetPrefix):
+		separator = " AND "
+	case strings.HasPrefix(key, orSetPrefix):
+		separator = " OR "
+	default:
+		return "", nil, 0, false
+	}
+
+	var members [][]patternToken
+	depth, start := 0, strings.Index(key, "(")+1
+	for i := start; i < len(key); {
+		switch c := key[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = quotedEnd(key, i)
+			continue
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' && depth == 0:
+			members = append(members, parsePattern(key[start:i]))
+			return separator, members, i + 1, true
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			members = append(members, parsePattern(key[start:i]))
+			start = i + len(", ")
+		}
+		i++
+	}
+	return "", nil, 0, false
+}
+
+// matchSet reports whether s matches the members of set joined in some order,
+// followed by the rest of the pattern. order holds the members placed so far.
+func matchSet(set patternToken, order []int, rest []patternToken, s string) bool {
+	if len(order) == len(set.members) {
+		var tokens []patternToken
+		for i, member := range order {
+			if i > 0 {
+				tokens = append(tokens, patternToken{kind: patternLiteral, text: set.text})
+			}
+			tokens = append(tokens, set.members[member]...)
+		}
+		return matchPattern(append(tokens, rest...), s)
+	}
+
+	for member := range set.members {
+		placed := false
+		for _, o := range order {
+			placed = placed || o == member
+		}
+		if !placed && matchSet(set, append(order[:len(order):len(order)], member), rest, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether s matches the pattern tokens.
+// Wildcards match the shortest balanced span of s that lets the rest of the pattern match.
+func matchPattern(tokens []patternToken, s string) bool {
+	if len(tokens) == 0 {
+		return s == ""
+	}
+
+	token := tokens[0]
+	switch token.kind {
+	case patternLiteral:
+		return strings.HasPrefix(s, token.text) && matchPattern(tokens[1:], s[len(token.text):])
+	case patternSet:
+		return matchSet(token, nil, tokens[1:], s)
+	}
+
+	depth := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = quotedEnd(s, i)
+		case c == '(' || c == '[':
+			depth++
+			i++
+		case c == ')' || c == ']':
+			if depth == 0 {
+				return false
+			}
+			depth--
+			i++
+		case depth == 0 && token.kind == patternAny && (c == ',' || hasLogicalOperator(s[i:])):
+			return false
+		default:
+			i++
+		}
+		if depth == 0 && matchPattern(tokens[1:], s[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLogicalOperator reports whether s starts with a top-level AND or OR,
+// which ends the value matched by <ANY>
+func hasLogicalOperator(s string) bool {
+	upper := strings.ToUpper(safeSlice(s, 0, len(" AND ")))
+	return upper == " AND " || strings.HasPrefix(upper, " OR ")
+}
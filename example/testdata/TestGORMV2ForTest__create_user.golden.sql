@@ -0,0 +1 @@
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Frank','frank@example.com',33) RETURNING `id`;
\ No newline at end of file
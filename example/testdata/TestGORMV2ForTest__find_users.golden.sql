@@ -0,0 +1 @@
+SELECT * FROM `users` WHERE `age`>30;
\ No newline at end of file
@@ -0,0 +1,3 @@
+SELECT * FROM `users` WHERE `name`='Grace';
+SELECT * FROM `users` WHERE `name`='Grace';
+SELECT * FROM `users` WHERE `name`='Grace';
\ No newline at end of file
@@ -0,0 +1,3 @@
+SELECT * FROM `users` WHERE `name`='Heidi';
+SELECT * FROM `users` WHERE `name`='Heidi';
+SELECT * FROM `users` WHERE `name`='Heidi';
\ No newline at end of file
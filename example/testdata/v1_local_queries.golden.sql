@@ -0,0 +1,3 @@
+INSERT INTO `products` (`name`,`code`,`price`,`description`) VALUES ('Keyboard','KEY001',49.99,'');
+SELECT * FROM `products` WHERE (`price`>10);
+DELETE FROM `products` WHERE `products`.`id`=1;
\ No newline at end of file
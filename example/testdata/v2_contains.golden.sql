@@ -0,0 +1,2 @@
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Grace','grace@example.com',45) RETURNING `id`;
+SELECT * FROM `users` WHERE `age`>40;
\ No newline at end of file
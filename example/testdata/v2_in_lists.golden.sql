@@ -0,0 +1,2 @@
+SELECT * FROM `users` WHERE `id` IN (1,2,3);
+SELECT * FROM `users` WHERE `age`=30;
@@ -0,0 +1,2 @@
+INSERT INTO `articles` (`title`,`created_at`,`updated_at`) VALUES ('Golden tests','<TIMESTAMP>','<TIMESTAMP>') RETURNING `id`;
+UPDATE `articles` SET `title`='Golden tests with masks', `updated_at`='<TIMESTAMP>' WHERE `id`='<ID>';
\ No newline at end of file
@@ -1 +1 @@
-INSERT INTO `users` (`name`,`email`,`age`) VALUES ("Bob","bob@example.com",35) RETURNING `id`;
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Bob','bob@example.com',35) RETURNING `id`;
\ No newline at end of file
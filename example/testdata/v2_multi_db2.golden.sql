@@ -1 +1 @@
-INSERT INTO `users` (`name`,`email`,`age`) VALUES ("Charlie","charlie@example.com",40) RETURNING `id`;
\ No newline at end of file
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Charlie','charlie@example.com',40) RETURNING `id`;
\ No newline at end of file
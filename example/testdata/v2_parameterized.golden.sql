@@ -0,0 +1,4 @@
+-- args: ["John Doe","john@example.com",30]
+INSERT INTO `users` (`name`,`email`,`age`) VALUES (?,?,?) RETURNING `id`;
+-- args: [25]
+SELECT * FROM `users` WHERE `age`>?;
\ No newline at end of file
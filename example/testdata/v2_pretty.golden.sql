@@ -0,0 +1,16 @@
+INSERT INTO `users` (`name`,`email`,`age`)
+VALUES ('Karl','karl@example.com',52)
+RETURNING `id`;
+SELECT `name`,
+  `email`
+FROM `users`
+WHERE (`age` BETWEEN 40 AND 60)
+  AND `name`!='Mallory'
+  AND `id` IN (
+    SELECT `id`
+    FROM `users`
+    WHERE `email` LIKE '%@example.com'
+  )
+ORDER BY `age` DESC,
+  `name`
+LIMIT 5;
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT * FROM `users` WHERE `id`=1;
\ No newline at end of file
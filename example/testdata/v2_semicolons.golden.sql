@@ -0,0 +1,4 @@
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Ivan;
+DROP TABLE users;','ivan@example.com',29) RETURNING `id`;
+SELECT * FROM `users` WHERE `name` LIKE '%;
+%';
\ No newline at end of file
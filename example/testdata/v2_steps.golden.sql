@@ -0,0 +1,6 @@
+-- step: sign up
+INSERT INTO `users` (`name`,`email`,`age`) VALUES ('Judy','judy@example.com',27) RETURNING `id`;
+-- step: birthday
+UPDATE `users` SET `age`=28 WHERE `id`=1;
+-- step: close account
+DELETE FROM `users` WHERE `users`.`id`=1;
\ No newline at end of file
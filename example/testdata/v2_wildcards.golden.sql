@@ -0,0 +1,2 @@
+INSERT INTO `users` (`name`,`email`,`age`) VALUES (<ANY>,'wildcard@example.com',33) RETURNING `id`;
+SELECT * FROM `users` WHERE `id` IN (<LIST>);
\ No newline at end of file
@@ -0,0 +1,166 @@
+package example
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/po3rin/gormgolden/gormgoldenv1"
+	"github.com/po3rin/gormgolden/internal/testutil"
+)
+
+func TestGORMV1LocalManagement(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Create plugin with local management
+	plugin := gormgoldenv1.New("testdata/v1_local_queries.golden.sql")
+	err = plugin.Register(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AutoMigrate(&Product{})
+
+	// Use local methods on plugin instance
+	plugin.Clear() // Clear migration queries
+
+	product := Product{Name: "Keyboard", Code: "KEY001", Price: 49.99}
+	db.Create(&product)
+
+	var products []Product
+	db.Where("price > ?", 10).Find(&products)
+
+	// Test local disable/enable
+	plugin.Disable()
+	db.Model(&product).Update("price", 39.99) // This won't be recorded
+
+	plugin.Enable()
+	db.Delete(&product) // This will be recorded
+
+	queries := plugin.GetQueries()
+	if len(queries) != 3 { // CREATE, SELECT, DELETE (UPDATE was disabled)
+		t.Errorf("expected 3 queries, got %d", len(queries))
+	}
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV1MultiplePluginInstances(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Two plugins on the same DB register independent callbacks
+	plugin1 := gormgoldenv1.New("")
+	plugin2 := gormgoldenv1.New("")
+	if err := plugin1.Register(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin2.Register(db); err != nil {
+		t.Fatal(err)
+	}
+
+	db.AutoMigrate(&Product{})
+	plugin1.Clear()
+	plugin2.Clear()
+
+	product := Product{Name: "Monitor", Code: "MON001", Price: 199.99}
+	db.Create(&product)
+
+	plugin2.Clear()
+	db.First(&product, product.ID)
+
+	if queries := plugin1.GetQueries(); len(queries) != 2 {
+		t.Errorf("plugin1: expected 2 queries, got %d", len(queries))
+	}
+	if queries := plugin2.GetQueries(); len(queries) != 1 {
+		t.Errorf("plugin2: expected 1 query, got %d", len(queries))
+	}
+}
+
+func TestGORMV1Unregister(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.AutoMigrate(&Product{})
+
+	plugin := gormgoldenv1.New("")
+	err = plugin.Register(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product := Product{Name: "Tablet", Code: "TAB001", Price: 299.99}
+	db.Create(&product)
+
+	err = plugin.Detach(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Detach(db); err == nil {
+		t.Error("expected detaching a plugin that is not registered to fail")
+	}
+	db.First(&product, product.ID)
+
+	if queries := plugin.GetQueries(); len(queries) != 1 {
+		t.Errorf("expected 1 query after detach, got %d", len(queries))
+	}
+
+	// Package-level registration can be undone as well
+	err = gormgoldenv1.Register(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.First(&product, product.ID)
+	if queries := gormgoldenv1.GetQueries(); len(queries) != 1 {
+		t.Errorf("expected 1 query before unregister, got %d", len(queries))
+	}
+
+	err = gormgoldenv1.Unregister(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.First(&product, product.ID)
+	if queries := gormgoldenv1.GetQueries(); len(queries) != 0 {
+		t.Errorf("expected no queries after unregister, got %d", len(queries))
+	}
+}
+
+func TestGORMV1NPlusOne(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	plugin := gormgoldenv1.New("")
+	if err := plugin.Register(db); err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&Product{})
+	for _, code := range []string{"A1", "B2", "C3"} {
+		db.Create(&Product{Name: code, Code: code, Price: 10})
+	}
+	plugin.Clear()
+
+	for _, code := range []string{"A1", "B2", "C3"} {
+		var product Product
+		db.Where("code = ?", code).First(&product)
+	}
+
+	recorder := &testutil.FailureRecorder{TB: t}
+	plugin.AssertNoNPlusOne(recorder, 2)
+	if len(recorder.Failures) != 1 {
+		t.Errorf("expected the N+1 pattern to be reported, got %q", recorder.Failures)
+	}
+	plugin.AssertNoNPlusOne(t, 3)
+}
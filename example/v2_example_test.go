@@ -1,9 +1,15 @@
 package example
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/po3rin/gormgolden/common"
 	"github.com/po3rin/gormgolden/gormgoldenv2"
+	"github.com/po3rin/gormgolden/internal/testutil"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -93,4 +99,421 @@ func TestGORMV2EnableDisable(t *testing.T) {
 	if len(plugin.GetQueries()) != 1 {
 		t.Error("expected 1 query when enabled")
 	}
-}
\ No newline at end of file
+}
+
+func TestGORMV2Events(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("")
+	err = db.Use(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin.Clear()
+
+	user := User{Name: "Eve", Email: "eve@example.com", Age: 22}
+	db.Create(&user)
+	db.Model(&user).Update("age", 23)
+
+	var missing User
+	db.First(&missing, 999)
+
+	events := plugin.GetEvents()
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	expected := []common.Operation{common.OperationCreate, common.OperationUpdate, common.OperationQuery}
+	for i, event := range events {
+		if event.Operation != expected[i] {
+			t.Errorf("event %d: operation = %q, want %q", i, event.Operation, expected[i])
+		}
+		if event.Table != "users" {
+			t.Errorf("event %d: table = %q, want users", i, event.Table)
+		}
+		if event.RawSQL == "" || event.Timestamp.IsZero() || event.Sequence == 0 {
+			t.Errorf("event %d: metadata not recorded: %+v", i, event)
+		}
+	}
+	if events[1].RowsAffected != 1 {
+		t.Errorf("update: rows affected = %d, want 1", events[1].RowsAffected)
+	}
+	if events[2].Error == nil {
+		t.Error("missing record: expected error to be recorded")
+	}
+}
+
+func TestGORMV2CallerComments(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("", gormgoldenv2.WithCallerComments())
+	err = db.Use(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin.Clear()
+
+	var users []User
+	db.Where("age > ?", 25).Find(&users)
+
+	events := plugin.GetEvents()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	caller := events[0].Caller
+	if !strings.HasSuffix(caller.File, "v2_example_test.go") || !strings.HasSuffix(caller.Function, "TestGORMV2CallerComments") {
+		t.Errorf("caller = %+v, want this test function", caller)
+	}
+
+	path := filepath.Join(t.TempDir(), "callers.golden.sql")
+	if err := plugin.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "-- caller: example/v2_example_test.go:") {
+		t.Errorf("golden content = %q, want caller comment first", data)
+	}
+}
+
+func TestGORMV2Parameterized(t *testing.T) {
+	record := func(user User) *gormgoldenv2.Plugin {
+		db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plugin := gormgoldenv2.New("testdata/v2_parameterized.golden.sql", gormgoldenv2.WithParameterized())
+		if err := db.Use(plugin); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AutoMigrate(&User{}); err != nil {
+			t.Fatal(err)
+		}
+		plugin.Clear()
+
+		db.Create(&user)
+		var users []User
+		db.Where("age > ?", 25).Find(&users)
+		return plugin
+	}
+
+	// Golden file holds the placeholders and the args of this fixture
+	record(User{Name: "John Doe", Email: "john@example.com", Age: 30}).AssertGolden(t)
+
+	// Different fixture data only changes the args
+	other := record(User{Name: "Jane Roe", Email: "jane@example.com", Age: 41})
+	if queries := other.GetQueries(); !strings.Contains(queries[0], "Jane Roe") {
+		t.Errorf("expected recorded queries to inline the bound values, got %q", queries[0])
+	}
+	// Updating from the shape-only assertion keeps the args of the fixture above
+	other.AssertGolden(t, common.ShapeOnly())
+}
+
+type Article struct {
+	ID        uint `gorm:"primaryKey"`
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func TestGORMV2Maskers(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_maskers.golden.sql",
+		gormgoldenv2.WithMaskers(common.DefaultMaskers()...),
+		gormgoldenv2.WithMaskers(common.ColumnMasker("articles.id", "<ID>")),
+	)
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Article{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// CreatedAt and UpdatedAt are set to time.Now() on every run
+	article := Article{Title: "Golden tests"}
+	db.Create(&article)
+	db.Model(&article).Update("title", "Golden tests with masks")
+
+	queries := plugin.GetQueries()
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(queries))
+	}
+	if !strings.Contains(queries[0], "'<TIMESTAMP>'") {
+		t.Errorf("expected timestamps to be masked, got %q", queries[0])
+	}
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV2ContainsGolden(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_contains.golden.sql")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	var count int64
+	db.Model(&User{}).Count(&count) // unrelated lookup, not in the golden file
+	db.Create(&User{Name: "Grace", Email: "grace@example.com", Age: 45})
+	db.Model(&User{}).Count(&count) // unrelated lookup, not in the golden file
+	var users []User
+	db.Where("age > ?", 40).Find(&users)
+
+	plugin.AssertContainsGolden(t)
+	plugin.AssertSubsetGolden(t)
+
+	// The golden queries are recorded, but not in order
+	plugin.Clear()
+	db.Where("age > ?", 40).Find(&users)
+	db.Create(&User{Name: "Grace", Email: "grace2@example.com", Age: 45})
+
+	recorder := &testutil.FailureRecorder{TB: t}
+	plugin.AssertContainsGolden(recorder, common.ShapeOnly(), common.CompareOnly())
+	if len(recorder.Failures) != 1 {
+		t.Errorf("expected queries out of order to fail, got %q", recorder.Failures)
+	}
+	plugin.AssertSubsetGolden(t, common.ShapeOnly())
+}
+
+func TestGORMV2Wildcards(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_wildcards.golden.sql")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// The golden file matches any user and any set of IDs
+	user := User{Name: "user-" + time.Now().Format(time.RFC3339Nano), Email: "wildcard@example.com", Age: 33}
+	db.Create(&user)
+	var users []User
+	db.Where("id IN ?", []uint{user.ID, user.ID + 1}).Find(&users)
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV2StructuredGolden(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_structured.golden.yaml", gormgoldenv2.WithParameterized())
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	db.Create(&User{Name: "Heidi", Email: "heidi@example.com", Age: 38})
+	db.Model(&User{}).Where("age > ?", 30).Update("age", 39)
+	var users []User
+	db.Where("name = ?", "Heidi; the second").Find(&users)
+
+	plugin.AssertGolden(t, common.CompareFields(common.FieldSQL, common.FieldArgs, common.FieldOperation, common.FieldTable, common.FieldRowsAffected))
+}
+
+func TestGORMV2SemicolonsInValues(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_semicolons.golden.sql")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// Values holding ";\n" do not split the golden file's queries
+	db.Create(&User{Name: "Ivan;\nDROP TABLE users;", Email: "ivan@example.com", Age: 29})
+	var users []User
+	db.Where("name LIKE ?", "%;\n%").Find(&users)
+
+	plugin.AssertGolden(t)
+	plugin.AssertGoldenSorted(t)
+}
+
+func TestGORMV2Steps(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_steps.golden.sql")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// One golden file documents the whole scenario, one section per step
+	plugin.Step("sign up")
+	user := User{Name: "Judy", Email: "judy@example.com", Age: 27}
+	db.Create(&user)
+
+	plugin.Step("birthday")
+	db.Model(&user).Update("age", 28)
+
+	plugin.Step("close account")
+	db.Delete(&user)
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV2PrettySQL(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("testdata/v2_pretty.golden.sql", gormgoldenv2.WithPrettySQL())
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	db.Create(&User{Name: "Karl", Email: "karl@example.com", Age: 52})
+	var users []User
+	db.Select("name", "email").
+		Where("age BETWEEN ? AND ?", 40, 60).
+		Where("name <> ?", "Mallory").
+		Where("id IN (SELECT id FROM users WHERE email LIKE ?)", "%@example.com").
+		Order("age DESC").Order("name").
+		Limit(5).
+		Find(&users)
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV2EquivalentToV1(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Product{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// The same operations as TestGORMV1SQLCapture, ported to GORM v2
+	product := Product{
+		Name:        "Laptop",
+		Code:        "LAP001",
+		Price:       999.99,
+		Description: "High-performance laptop",
+	}
+	db.Create(&product)
+
+	var products []Product
+	db.Where("price > ?", 500).Find(&products)
+
+	db.Model(&product).Update("price", 899.99)
+
+	db.Delete(&product)
+
+	plugin.AssertEquivalentTo(t, "testdata/v1_queries.golden.sql")
+}
+
+func TestGORMV2Rules(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The golden file has `id`=1 where GORM qualifies the column with its table
+	plugin := gormgoldenv2.New("testdata/v2_rules.golden.sql",
+		gormgoldenv2.WithRules(common.RegexpRule("table qualifiers", "`\\w+`\\.", "")),
+	)
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	var users []User
+	db.Find(&users, 1)
+
+	plugin.AssertGolden(t)
+}
+
+func TestGORMV2InLists(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The golden file lists the IDs in another order, and has `age`=30 for the one-element list
+	plugin := gormgoldenv2.New("testdata/v2_in_lists.golden.sql")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	var users []User
+	db.Where("id IN ?", []int{3, 1, 2}).Find(&users)
+	db.Where("age IN ?", []int{30}).Find(&users)
+
+	plugin.AssertGolden(t)
+}
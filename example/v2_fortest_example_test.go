@@ -0,0 +1,45 @@
+package example
+
+import (
+	"testing"
+
+	"github.com/po3rin/gormgolden/gormgoldenv2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGORMV2ForTest(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("create user", func(t *testing.T) {
+		// Golden file: testdata/TestGORMV2ForTest__create_user.golden.sql
+		tx, _ := gormgoldenv2.ForTest(t, db)
+
+		user := User{Name: "Frank", Email: "frank@example.com", Age: 33}
+		tx.Create(&user)
+
+		// Queries outside the test session are not recorded
+		var count int64
+		db.Model(&User{}).Count(&count)
+	})
+
+	t.Run("find users", func(t *testing.T) {
+		// Golden file: testdata/TestGORMV2ForTest__find_users.golden.sql
+		tx, plugin := gormgoldenv2.ForTest(t, db)
+
+		var users []User
+		tx.Where("age > ?", 30).Find(&users)
+
+		if queries := plugin.GetQueries(); len(queries) != 1 {
+			t.Errorf("expected 1 query, got %d", len(queries))
+		}
+	})
+}
@@ -109,4 +109,61 @@ func TestMultiplePluginInstances(t *testing.T) {
 	// Each plugin can assert its own golden file
 	plugin1.AssertGolden(t)
 	plugin2.AssertGolden(t)
-}
\ No newline at end of file
+}
+
+func TestGORMV2Detach(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("")
+	err = db.Use(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{Name: "Dave", Email: "dave@example.com", Age: 45}
+	db.Create(&user)
+
+	// Detached plugins stop recording but keep what they recorded
+	err = plugin.Detach(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Detach(db); err == nil {
+		t.Error("expected detaching a plugin that is not registered to fail")
+	}
+	db.First(&user, user.ID)
+
+	if queries := plugin.GetQueries(); len(queries) != 1 {
+		t.Errorf("expected 1 query after detach, got %d", len(queries))
+	}
+
+	// The plugin can be used again after detaching
+	err = db.Use(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.First(&user, user.ID)
+
+	if queries := plugin.GetQueries(); len(queries) != 2 {
+		t.Errorf("expected 2 queries after re-attaching, got %d", len(queries))
+	}
+
+	// Close detaches and releases the recorded queries
+	err = plugin.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.First(&user, user.ID)
+
+	if queries := plugin.GetQueries(); len(queries) != 0 {
+		t.Errorf("expected no queries after close, got %d", len(queries))
+	}
+}
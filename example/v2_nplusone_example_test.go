@@ -0,0 +1,96 @@
+package example
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/po3rin/gormgolden/common"
+	"github.com/po3rin/gormgolden/gormgoldenv2"
+	"github.com/po3rin/gormgolden/internal/testutil"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type Author struct {
+	ID    uint `gorm:"primaryKey"`
+	Name  string
+	Books []Book
+}
+
+type Book struct {
+	ID       uint `gorm:"primaryKey"`
+	AuthorID uint
+	Title    string
+}
+
+func TestGORMV2NPlusOne(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Author{}, &Book{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Ada", "Brian", "Claude"} {
+		db.Create(&Author{Name: name, Books: []Book{{Title: name + "'s book"}}})
+	}
+
+	// Loading the books of each author in a loop
+	plugin.Clear()
+	var authors []Author
+	db.Find(&authors)
+	for i := range authors {
+		db.Where("author_id = ?", authors[i].ID).Find(&authors[i].Books)
+	}
+
+	recorder := &testutil.FailureRecorder{TB: t}
+	plugin.AssertNoNPlusOne(recorder, 2)
+	if len(recorder.Failures) != 1 {
+		t.Fatalf("expected the N+1 pattern to be reported, got %q", recorder.Failures)
+	}
+	if report := recorder.Failures[0]; !strings.Contains(report, "3x SELECT * FROM `books` WHERE `author_id`=?") ||
+		!strings.Contains(report, "3x from example/v2_nplusone_example_test.go:") {
+		t.Errorf("expected the report to name the shape and the call site, got:\n%s", report)
+	}
+
+	// Preload loads all books with a single query
+	plugin.Clear()
+	db.Preload("Books").Find(&authors)
+	plugin.AssertNoNPlusOne(t, 1)
+}
+
+func TestGORMV2QueryBudget(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := gormgoldenv2.New("")
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Author{}, &Book{}); err != nil {
+		t.Fatal(err)
+	}
+	plugin.Clear()
+
+	// Creating an author with books inserts the author and all books in one statement each
+	db.Create(&Author{Name: "Ada", Books: []Book{{Title: "Notes"}, {Title: "Sketches"}}})
+	var authors []Author
+	db.Preload("Books").Find(&authors)
+
+	plugin.AssertQueryCount(t, 4)
+	plugin.AssertMaxQueries(t, 4)
+	plugin.AssertBudget(t, common.Budget{Select: 2, Insert: 2, Tables: map[string]int{"books": 2}})
+
+	recorder := &testutil.FailureRecorder{TB: t}
+	plugin.AssertBudget(recorder, common.Budget{Select: common.Unlimited, Insert: common.Unlimited, Tables: map[string]int{"books": 1}})
+	if len(recorder.Failures) != 1 {
+		t.Errorf("expected the books budget to be exceeded, got %q", recorder.Failures)
+	}
+}
@@ -0,0 +1,64 @@
+package example
+
+import (
+	"context"
+	"testing"
+
+	"github.com/po3rin/gormgolden/gormgoldenv2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGORMV2ParallelRecorders(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens a new database, so share a single one
+	sqlDB.SetMaxOpenConns(1)
+
+	plugin := gormgoldenv2.New("testdata/v2_recorders.golden.sql")
+	err = db.Use(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin.Clear()
+
+	users := []User{
+		{Name: "Grace", Email: "grace@example.com", Age: 36},
+		{Name: "Heidi", Email: "heidi@example.com", Age: 27},
+	}
+
+	t.Run("group", func(t *testing.T) {
+		for _, user := range users {
+			user := user
+			t.Run(user.Name, func(t *testing.T) {
+				t.Parallel()
+
+				// Golden file: testdata/TestGORMV2ParallelRecorders__group__<name>.golden.sql
+				tx := db.WithContext(gormgoldenv2.WithRecorder(context.Background(), t.Name()))
+				for i := 0; i < 3; i++ {
+					var found []User
+					tx.Where("name = ?", user.Name).Find(&found)
+				}
+
+				plugin.Recorder(t.Name()).AssertGolden(t)
+			})
+		}
+	})
+
+	// Queries issued with a recorder are not part of the plugin's own recording
+	if queries := plugin.GetQueries(); len(queries) != 0 {
+		t.Errorf("expected no queries in the plugin's own recording, got %d", len(queries))
+	}
+}
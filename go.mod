@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/jinzhu/gorm v1.9.16
 	github.com/pingcap/tidb/parser v0.0.0-20231013125129-93a834a6bf8d
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/sqlite v1.5.1
 	gorm.io/gorm v1.25.0
 	gotest.tools/v3 v3.5.1
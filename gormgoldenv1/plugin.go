@@ -2,6 +2,7 @@ package gormgoldenv1
 
 import (
 	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"sync"
@@ -13,43 +14,392 @@ import (
 )
 
 var (
-	queryManagers  = &sync.Map{} // map[*gorm.DB]*common.QueryManager
-	filePathToQM   = &sync.Map{} // map[string]*common.QueryManager (filePath -> queryManager)
-	dbToFilePath   = &sync.Map{} // map[*gorm.DB]string (db -> filePath)
-	currentFilePath string        // For backward compatibility with functions that don't take filePath
-	currentMutex   sync.RWMutex
+	plugins          = &sync.Map{} // map[*gorm.DB]*Plugin
+	filePathToPlugin = &sync.Map{} // map[string]*Plugin (filePath -> plugin)
+	currentFilePath  string        // For backward compatibility with functions that don't take filePath
+	currentMutex     sync.RWMutex
 )
 
-func Register(db *gorm.DB, filePath string) error {
-	queryManager := common.NewQueryManager(filePath)
-	queryManagers.Store(db, queryManager)
-	filePathToQM.Store(filePath, queryManager)
-	dbToFilePath.Store(db, filePath)
+// Plugin records the queries executed through a GORM v1 database.
+// It mirrors gormgoldenv2.Plugin; each instance registers its own callbacks
+// and keeps its own queries.
+type Plugin struct {
+	GoldenFile     string
+	queryManager   *common.QueryManager
+	managerOptions []common.Option
+	instanceID     string
+	dbs            []*gorm.DB     // Databases the plugin's callbacks are registered on
+	dialect        common.Dialect // Set with WithDialect, or detected from the first database
+	mu             sync.Mutex
+}
 
-	// Update current filePath for backward compatibility
-	currentMutex.Lock()
-	currentFilePath = filePath
-	currentMutex.Unlock()
+// Option configures a Plugin
+type Option func(*Plugin)
 
-	// Create a closure that captures the queryManager
-	afterCallbackFunc := func(scope *gorm.Scope) {
-		sql := scope.SQL
-		vars := scope.SQLVars
+// WithCallerComments writes a "-- caller: dir/file.go:42" comment above each query in the golden file
+func WithCallerComments() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithCallerComments())
+	}
+}
 
-		if sql == "" {
-			return
-		}
+// WithDialect sets the SQL dialect queries are normalized for.
+// By default it is detected from db.Dialect().GetName() when the plugin is registered.
+func WithDialect(d common.Dialect) Option {
+	return func(p *Plugin) {
+		p.dialect = d
+		p.managerOptions = append(p.managerOptions, common.WithDialect(d))
+	}
+}
+
+// WithParameterized records queries with "?" placeholders and writes the bound values
+// to the golden file as an "-- args:" comment, so fixture changes do not rewrite the SQL
+func WithParameterized() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithParameterized())
+	}
+}
+
+// WithPrettySQL writes golden file queries over several lines, one clause per line
+func WithPrettySQL() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithPrettySQL())
+	}
+}
+
+// WithColor turns colored assertion output on or off, overriding the detection from
+// NO_COLOR and whether stdout is a terminal
+func WithColor(enabled bool) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithColor(enabled))
+	}
+}
+
+// WithVerbosity sets when assertions log the comparison of matching queries,
+// by default only with go test -v
+func WithVerbosity(v common.Verbosity) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithVerbosity(v))
+	}
+}
+
+// WithRules adds normalization rules, so variations a team considers harmless compare equal
+func WithRules(rules ...common.NormalizationRule) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithRules(rules...))
+	}
+}
+
+// WithoutRules turns off built-in normalization rules by name, e.g. common.RuleWhereOrder
+func WithoutRules(names ...common.RuleName) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithoutRules(names...))
+	}
+}
+
+// WithMaskers replaces volatile values such as timestamps and generated IDs with stable tokens
+// in recorded and golden queries
+func WithMaskers(maskers ...common.Masker) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithMaskers(maskers...))
+	}
+}
+
+func New(filePath string, opts ...Option) *Plugin {
+	rand.Seed(time.Now().UnixNano())
+	instanceID := fmt.Sprintf("gormgolden_%d_%d", time.Now().UnixNano(), rand.Intn(100000))
+	p := &Plugin{
+		GoldenFile:     filePath,
+		instanceID:     instanceID,
+		managerOptions: []common.Option{common.WithGORMVersion(common.GORMv1)},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.queryManager = common.NewQueryManager(filePath, p.managerOptions...)
+	return p
+}
+
+func (p *Plugin) Name() string {
+	return p.instanceID
+}
+
+// Register registers the plugin's callbacks on db
+func (p *Plugin) Register(db *gorm.DB) error {
+	p.mu.Lock()
+	p.dbs = append(p.dbs, db)
+	if p.dialect == "" && db.Dialect() != nil && p.queryManager != nil {
+		p.dialect = common.DialectFromName(db.Dialect().GetName())
+		p.queryManager.SetDialect(p.dialect)
+	}
+	p.mu.Unlock()
+
+	// Remember when each statement started so the after callback can compute its duration
+	beforeCallbackFunc := func(scope *gorm.Scope) {
+		scope.InstanceSet(p.startTimeKey(), time.Now())
+	}
+
+	// Create a closure that captures the plugin's queryManager and the operation kind
+	afterCallbackFunc := func(op common.Operation) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			sql := scope.SQL
+			vars := scope.SQLVars
 
-		fullSQL := buildFullSQL(sql, vars)
-		queryManager.AddQuery(fullSQL)
+			qm := p.manager()
+			if sql == "" || qm == nil {
+				return
+			}
+
+			fullSQL := buildFullSQL(sql, vars)
+			event := common.QueryEvent{
+				SQL:          fullSQL,
+				RawSQL:       sql,
+				Vars:         append([]interface{}(nil), vars...),
+				Operation:    op,
+				Table:        scope.TableName(),
+				RowsAffected: scope.DB().RowsAffected,
+				Error:        scope.DB().Error,
+				Caller:       common.FindCaller(),
+			}
+			if started, ok := scope.InstanceGet(p.startTimeKey()); ok {
+				if startedAt, ok := started.(time.Time); ok {
+					event.Duration = time.Since(startedAt)
+				}
+			}
+			qm.AddEvent(event)
+		}
 	}
 
 	// Register callbacks for all operations
-	db.Callback().Create().After("gorm:create").Register("gormgolden:after_create", afterCallbackFunc)
-	db.Callback().Query().After("gorm:query").Register("gormgolden:after_query", afterCallbackFunc)
-	db.Callback().Update().After("gorm:update").Register("gormgolden:after_update", afterCallbackFunc)
-	db.Callback().Delete().After("gorm:delete").Register("gormgolden:after_delete", afterCallbackFunc)
-	db.Callback().RowQuery().After("gorm:row_query").Register("gormgolden:after_row_query", afterCallbackFunc)
+	callback := db.Callback()
+	callback.Create().Before("gorm:create").Register(fmt.Sprintf("%s:before_create", p.instanceID), beforeCallbackFunc)
+	callback.Query().Before("gorm:query").Register(fmt.Sprintf("%s:before_query", p.instanceID), beforeCallbackFunc)
+	callback.Update().Before("gorm:update").Register(fmt.Sprintf("%s:before_update", p.instanceID), beforeCallbackFunc)
+	callback.Delete().Before("gorm:delete").Register(fmt.Sprintf("%s:before_delete", p.instanceID), beforeCallbackFunc)
+	callback.RowQuery().Before("gorm:row_query").Register(fmt.Sprintf("%s:before_row_query", p.instanceID), beforeCallbackFunc)
+
+	callback.Create().After("gorm:create").Register(fmt.Sprintf("%s:after_create", p.instanceID), afterCallbackFunc(common.OperationCreate))
+	callback.Query().After("gorm:query").Register(fmt.Sprintf("%s:after_query", p.instanceID), afterCallbackFunc(common.OperationQuery))
+	callback.Update().After("gorm:update").Register(fmt.Sprintf("%s:after_update", p.instanceID), afterCallbackFunc(common.OperationUpdate))
+	callback.Delete().After("gorm:delete").Register(fmt.Sprintf("%s:after_delete", p.instanceID), afterCallbackFunc(common.OperationDelete))
+	callback.RowQuery().After("gorm:row_query").Register(fmt.Sprintf("%s:after_row_query", p.instanceID), afterCallbackFunc(common.OperationRow))
+
+	return nil
+}
+
+// Detach removes the plugin's callbacks from db, so a shared *gorm.DB does not
+// keep accumulating callbacks from every test that used it. It fails when the
+// plugin was not registered on db with Register.
+// Recorded queries are kept until Close is called.
+func (p *Plugin) Detach(db *gorm.DB) error {
+	p.mu.Lock()
+	registered := false
+	for i, attached := range p.dbs {
+		if attached == db {
+			p.dbs = append(p.dbs[:i], p.dbs[i+1:]...)
+			registered = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("gormgolden: plugin %s is not registered on this database", p.instanceID)
+	}
+
+	// GORM logs the removal of each callback, which is noise in every test cleanup
+	quiet := db.New()
+	quiet.SetLogger(silentLogger{})
+	callback := quiet.Callback()
+	callback.Create().Remove(fmt.Sprintf("%s:before_create", p.instanceID))
+	callback.Query().Remove(fmt.Sprintf("%s:before_query", p.instanceID))
+	callback.Update().Remove(fmt.Sprintf("%s:before_update", p.instanceID))
+	callback.Delete().Remove(fmt.Sprintf("%s:before_delete", p.instanceID))
+	callback.RowQuery().Remove(fmt.Sprintf("%s:before_row_query", p.instanceID))
+
+	callback.Create().Remove(fmt.Sprintf("%s:after_create", p.instanceID))
+	callback.Query().Remove(fmt.Sprintf("%s:after_query", p.instanceID))
+	callback.Update().Remove(fmt.Sprintf("%s:after_update", p.instanceID))
+	callback.Delete().Remove(fmt.Sprintf("%s:after_delete", p.instanceID))
+	callback.RowQuery().Remove(fmt.Sprintf("%s:after_row_query", p.instanceID))
+
+	return nil
+}
+
+// silentLogger discards GORM's log output
+type silentLogger struct{}
+
+func (silentLogger) Print(...interface{}) {}
+
+// Close detaches the plugin from every database it was registered on and
+// releases its QueryManager. The plugin records nothing after Close.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	dbs := append([]*gorm.DB(nil), p.dbs...)
+	p.mu.Unlock()
+
+	for _, db := range dbs {
+		if err := p.Detach(db); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.queryManager = nil
+	p.mu.Unlock()
+	return nil
+}
+
+// CloseOnCleanup closes the plugin when the test and all its subtests complete
+func (p *Plugin) CloseOnCleanup(t testing.TB) {
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("gormgolden: failed to close plugin: %v", err)
+		}
+	})
+}
+
+// manager returns the plugin's QueryManager, or nil once the plugin is closed
+func (p *Plugin) manager() *common.QueryManager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queryManager
+}
+
+// startTimeKey is the scope instance key holding the time a statement started
+func (p *Plugin) startTimeKey() string {
+	return p.instanceID + ":started_at"
+}
+
+// Local methods on Plugin for managing queries
+func (p *Plugin) Enable() {
+	if qm := p.manager(); qm != nil {
+		qm.Enable()
+	}
+}
+
+func (p *Plugin) Disable() {
+	if qm := p.manager(); qm != nil {
+		qm.Disable()
+	}
+}
+
+func (p *Plugin) Clear() {
+	if qm := p.manager(); qm != nil {
+		qm.Clear()
+	}
+}
+
+// Step starts a named section of the recording, written to golden files as a "-- step: name" header
+func (p *Plugin) Step(name string) {
+	if qm := p.manager(); qm != nil {
+		qm.Step(name)
+	}
+}
+
+func (p *Plugin) GetQueries() []string {
+	if qm := p.manager(); qm != nil {
+		return qm.GetQueries()
+	}
+	return []string{}
+}
+
+// GetEvents returns the recorded queries together with their metadata
+func (p *Plugin) GetEvents() []common.QueryEvent {
+	if qm := p.manager(); qm != nil {
+		return qm.GetEvents()
+	}
+	return []common.QueryEvent{}
+}
+
+func (p *Plugin) SaveToFile(filePath string) error {
+	if qm := p.manager(); qm != nil {
+		return qm.SaveToFile(filePath)
+	}
+	return nil
+}
+
+func (p *Plugin) AssertGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertGolden(t, opts...)
+	}
+}
+
+// AssertGoldenSorted asserts the recorded queries against a golden file, ignoring query order.
+// This is useful when queries are executed in parallel and their order is non-deterministic.
+func (p *Plugin) AssertGoldenSorted(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertGoldenSorted(t, opts...)
+	}
+}
+
+// AssertContainsGolden asserts that the golden file's queries were recorded in order,
+// ignoring other queries recorded before, between and after them
+func (p *Plugin) AssertContainsGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertContainsGolden(t, opts...)
+	}
+}
+
+// AssertSubsetGolden asserts that every query of the golden file was recorded, in any order
+func (p *Plugin) AssertSubsetGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertSubsetGolden(t, opts...)
+	}
+}
+
+// AssertNoNPlusOne fails the test if a SELECT shape, ignoring literal values, was recorded
+// more than threshold times, reporting the call sites that issued it.
+// Pass common.IncludeWrites() to check INSERT, UPDATE and DELETE statements too.
+func (p *Plugin) AssertNoNPlusOne(t testing.TB, threshold int, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertNoNPlusOne(t, threshold, opts...)
+	}
+}
+
+// AssertQueryCount fails the test unless exactly n queries were recorded
+func (p *Plugin) AssertQueryCount(t testing.TB, n int) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertQueryCount(t, n)
+	}
+}
+
+// AssertMaxQueries fails the test if more than n queries were recorded
+func (p *Plugin) AssertMaxQueries(t testing.TB, n int) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertMaxQueries(t, n)
+	}
+}
+
+// AssertBudget fails the test if the recorded queries exceed the budget per statement type or table
+func (p *Plugin) AssertBudget(t testing.TB, budget common.Budget) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertBudget(t, budget)
+	}
+}
+
+// Register creates a Plugin for filePath and registers it on db.
+// The package-level functions below act on the plugin registered last.
+func Register(db *gorm.DB, filePath string, opts ...Option) error {
+	p := New(filePath, opts...)
+	if err := p.Register(db); err != nil {
+		return err
+	}
+
+	plugins.Store(db, p)
+	filePathToPlugin.Store(filePath, p)
+
+	// Update current filePath for backward compatibility
+	currentMutex.Lock()
+	currentFilePath = filePath
+	currentMutex.Unlock()
 
 	return nil
 }
@@ -104,91 +454,170 @@ func formatValue(v interface{}) string {
 	}
 }
 
-// getQueryManagerByFilePath returns the queryManager for a given filePath
-func getQueryManagerByFilePath(filePath string) *common.QueryManager {
-	if qm, ok := filePathToQM.Load(filePath); ok {
-		if queryManager, ok := qm.(*common.QueryManager); ok {
-			return queryManager
+// Unregister removes the callbacks registered on db by Register and
+// releases the plugin's recorded queries
+func Unregister(db *gorm.DB) error {
+	p := getPluginByDB(db)
+	if p == nil {
+		return nil
+	}
+
+	plugins.Delete(db)
+	filePathToPlugin.CompareAndDelete(p.GoldenFile, p)
+	return p.Close()
+}
+
+// getPluginByFilePath returns the plugin registered for a given filePath
+func getPluginByFilePath(filePath string) *Plugin {
+	if p, ok := filePathToPlugin.Load(filePath); ok {
+		if plugin, ok := p.(*Plugin); ok {
+			return plugin
 		}
 	}
 	return nil
 }
 
-// getQueryManagerByDB returns the queryManager for a given DB
-func getQueryManagerByDB(db *gorm.DB) *common.QueryManager {
-	if qm, ok := queryManagers.Load(db); ok {
-		if queryManager, ok := qm.(*common.QueryManager); ok {
-			return queryManager
+// getPluginByDB returns the plugin registered on a given DB
+func getPluginByDB(db *gorm.DB) *Plugin {
+	if p, ok := plugins.Load(db); ok {
+		if plugin, ok := p.(*Plugin); ok {
+			return plugin
 		}
 	}
 	return nil
 }
 
-// getCurrentQueryManager returns the current queryManager (for backward compatibility)
-func getCurrentQueryManager() *common.QueryManager {
+// getCurrentPlugin returns the plugin registered last (for backward compatibility)
+func getCurrentPlugin() *Plugin {
 	currentMutex.RLock()
 	fp := currentFilePath
 	currentMutex.RUnlock()
-	return getQueryManagerByFilePath(fp)
+	return getPluginByFilePath(fp)
 }
 
 // Public functions to control recording
 func Enable() {
-	if qm := getCurrentQueryManager(); qm != nil {
-		qm.Enable()
+	if p := getCurrentPlugin(); p != nil {
+		p.Enable()
 	}
 }
 
 func Disable() {
-	if qm := getCurrentQueryManager(); qm != nil {
-		qm.Disable()
+	if p := getCurrentPlugin(); p != nil {
+		p.Disable()
 	}
 }
 
 func Clear() {
-	if qm := getCurrentQueryManager(); qm != nil {
-		qm.Clear()
+	if p := getCurrentPlugin(); p != nil {
+		p.Clear()
+	}
+}
+
+// Step starts a named section of the current plugin's recording
+func Step(name string) {
+	if p := getCurrentPlugin(); p != nil {
+		p.Step(name)
 	}
 }
 
 // ClearDB clears queries for a specific DB instance (thread-safe for parallel tests)
 func ClearDB(db *gorm.DB) {
-	if qm := getQueryManagerByDB(db); qm != nil {
-		qm.Clear()
+	if p := getPluginByDB(db); p != nil {
+		p.Clear()
 	}
 }
 
 func GetQueries() []string {
-	if qm := getCurrentQueryManager(); qm != nil {
-		return qm.GetQueries()
+	if p := getCurrentPlugin(); p != nil {
+		return p.GetQueries()
 	}
 	return []string{}
 }
 
+// GetEvents returns the recorded queries together with their metadata
+func GetEvents() []common.QueryEvent {
+	if p := getCurrentPlugin(); p != nil {
+		return p.GetEvents()
+	}
+	return []common.QueryEvent{}
+}
+
 func SaveToFile(filePath string) error {
-	if qm := getCurrentQueryManager(); qm != nil {
-		return qm.SaveToFile(filePath)
+	if p := getCurrentPlugin(); p != nil {
+		return p.SaveToFile(filePath)
 	}
 	return nil
 }
 
-func AssertGolden(t *testing.T) {
-	if qm := getCurrentQueryManager(); qm != nil {
-		qm.AssertGolden(t)
+func AssertGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertGolden(t, opts...)
 	}
 }
 
 // AssertGoldenDB asserts golden file for a specific DB instance (thread-safe for parallel tests)
-func AssertGoldenDB(t *testing.T, db *gorm.DB) {
-	if qm := getQueryManagerByDB(db); qm != nil {
-		qm.AssertGolden(t)
+func AssertGoldenDB(t testing.TB, db *gorm.DB, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getPluginByDB(db); p != nil {
+		p.AssertGolden(t, opts...)
 	}
 }
 
 // AssertGoldenSortedDB asserts golden file for a specific DB instance, ignoring query order.
 // This is useful when queries are executed in parallel and their order is non-deterministic.
-func AssertGoldenSortedDB(t *testing.T, db *gorm.DB) {
-	if qm := getQueryManagerByDB(db); qm != nil {
-		qm.AssertGoldenSorted(t)
+func AssertGoldenSortedDB(t testing.TB, db *gorm.DB, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getPluginByDB(db); p != nil {
+		p.AssertGoldenSorted(t, opts...)
+	}
+}
+
+// AssertContainsGolden asserts that the golden file's queries were recorded in order
+func AssertContainsGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertContainsGolden(t, opts...)
+	}
+}
+
+// AssertSubsetGolden asserts that every query of the golden file was recorded, in any order
+func AssertSubsetGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertSubsetGolden(t, opts...)
+	}
+}
+
+// AssertNoNPlusOne fails the test if a SELECT shape was recorded more than threshold times
+func AssertNoNPlusOne(t testing.TB, threshold int, opts ...common.AssertOption) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertNoNPlusOne(t, threshold, opts...)
+	}
+}
+
+// AssertQueryCount fails the test unless exactly n queries were recorded
+func AssertQueryCount(t testing.TB, n int) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertQueryCount(t, n)
+	}
+}
+
+// AssertMaxQueries fails the test if more than n queries were recorded
+func AssertMaxQueries(t testing.TB, n int) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertMaxQueries(t, n)
+	}
+}
+
+// AssertBudget fails the test if the recorded queries exceed the budget per statement type or table
+func AssertBudget(t testing.TB, budget common.Budget) {
+	t.Helper()
+	if p := getCurrentPlugin(); p != nil {
+		p.AssertBudget(t, budget)
 	}
 }
@@ -10,23 +10,106 @@ import (
 
 	"github.com/po3rin/gormgolden/common"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 type Plugin struct {
-	GoldenFile   string
-	queryManager *common.QueryManager
-	instanceID   string
-	mu           sync.Mutex // Protects access to Statement during parallel execution
+	GoldenFile     string
+	queryManager   *common.QueryManager
+	managerOptions []common.Option
+	instanceID     string
+	dbs            []*gorm.DB                      // Databases the plugin's callbacks are registered on
+	scoped         bool                            // Only record statements issued through the ForTest session
+	recorders      map[string]*common.QueryManager // Recorders selected with WithRecorder, keyed by name
+	dialect        common.Dialect                  // Set with WithDialect, or detected from the first database
+	mu             sync.Mutex                      // Protects access to Statement during parallel execution
 }
 
-func New(filePath string) *Plugin {
+// Option configures a Plugin
+type Option func(*Plugin)
+
+// WithCallerComments writes a "-- caller: dir/file.go:42" comment above each query in the golden file
+func WithCallerComments() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithCallerComments())
+	}
+}
+
+// WithDialect sets the SQL dialect queries are normalized for.
+// By default it is detected from db.Dialector.Name() when the plugin is initialized.
+func WithDialect(d common.Dialect) Option {
+	return func(p *Plugin) {
+		p.dialect = d
+		p.managerOptions = append(p.managerOptions, common.WithDialect(d))
+	}
+}
+
+// WithParameterized records queries with "?" placeholders and writes the bound values
+// to the golden file as an "-- args:" comment, so fixture changes do not rewrite the SQL
+func WithParameterized() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithParameterized())
+	}
+}
+
+// WithPrettySQL writes golden file queries over several lines, one clause per line
+func WithPrettySQL() Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithPrettySQL())
+	}
+}
+
+// WithColor turns colored assertion output on or off, overriding the detection from
+// NO_COLOR and whether stdout is a terminal
+func WithColor(enabled bool) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithColor(enabled))
+	}
+}
+
+// WithVerbosity sets when assertions log the comparison of matching queries,
+// by default only with go test -v
+func WithVerbosity(v common.Verbosity) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithVerbosity(v))
+	}
+}
+
+// WithRules adds normalization rules, so variations a team considers harmless compare equal
+func WithRules(rules ...common.NormalizationRule) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithRules(rules...))
+	}
+}
+
+// WithoutRules turns off built-in normalization rules by name, e.g. common.RuleWhereOrder
+func WithoutRules(names ...common.RuleName) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithoutRules(names...))
+	}
+}
+
+// WithMaskers replaces volatile values such as timestamps and generated IDs with stable tokens
+// in recorded and golden queries
+func WithMaskers(maskers ...common.Masker) Option {
+	return func(p *Plugin) {
+		p.managerOptions = append(p.managerOptions, common.WithMaskers(maskers...))
+	}
+}
+
+func New(filePath string, opts ...Option) *Plugin {
 	rand.Seed(time.Now().UnixNano())
 	instanceID := fmt.Sprintf("gormgolden_%d_%d", time.Now().UnixNano(), rand.Intn(100000))
-	return &Plugin{
-		GoldenFile:   filePath,
-		queryManager: common.NewQueryManager(filePath),
-		instanceID:   instanceID,
+	p := &Plugin{
+		GoldenFile:     filePath,
+		instanceID:     instanceID,
+		managerOptions: []common.Option{common.WithGORMVersion(common.GORMv2)},
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	p.queryManager = common.NewQueryManager(filePath, p.managerOptions...)
+	return p
 }
 
 func (p *Plugin) Name() string {
@@ -34,56 +117,188 @@ func (p *Plugin) Name() string {
 }
 
 func (p *Plugin) Initialize(db *gorm.DB) error {
+	p.mu.Lock()
+	p.dbs = append(p.dbs, db)
+	if p.dialect == "" && db.Dialector != nil && p.queryManager != nil {
+		p.dialect = common.DialectFromName(db.Dialector.Name())
+		p.queryManager.SetDialect(p.dialect)
+		for _, recorder := range p.recorders {
+			recorder.SetDialect(p.dialect)
+		}
+	}
+	p.mu.Unlock()
+
 	// Register callbacks for all operations
 	callback := db.Callback()
 
-	// Use closure to capture the plugin's queryManager
-	afterCallbackFunc := func(db *gorm.DB) {
-		// Lock to protect Statement access from concurrent goroutines
-		p.mu.Lock()
-		defer p.mu.Unlock()
-
-		if db.Statement != nil && db.Statement.SQL.String() != "" {
-			// Immediately capture SQL and vars to avoid race conditions
-			sql := db.Statement.SQL.String()
-			vars := make([]interface{}, len(db.Statement.Vars))
-			copy(vars, db.Statement.Vars)
-
-			fullSQL := buildFullSQLWithVars(db.Dialector, sql, vars)
-
-			// Filter: only record top-level queries
-			trimmedSQL := strings.TrimSpace(fullSQL)
-
-			// Strip leading SQL comments to find the actual SELECT statement
-			sqlWithoutComments := trimmedSQL
-			for strings.HasPrefix(sqlWithoutComments, "/*") {
-				endComment := strings.Index(sqlWithoutComments, "*/")
-				if endComment == -1 {
-					break
+	// Remember when each statement started so the after callback can compute its duration
+	beforeCallbackFunc := func(db *gorm.DB) {
+		db.InstanceSet(p.startTimeKey(), time.Now())
+	}
+
+	// Use closure to capture the plugin's queryManager and the operation kind
+	afterCallbackFunc := func(op common.Operation) func(db *gorm.DB) {
+		return func(db *gorm.DB) {
+			// Lock to protect Statement access from concurrent goroutines
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			if p.queryManager != nil && db.Statement != nil && db.Statement.SQL.String() != "" && p.inScope(db) {
+				// Immediately capture SQL and vars to avoid race conditions
+				sql := db.Statement.SQL.String()
+				vars := make([]interface{}, len(db.Statement.Vars))
+				copy(vars, db.Statement.Vars)
+
+				fullSQL := buildFullSQLWithVars(db.Dialector, sql, vars)
+
+				// Filter: only record top-level queries
+				trimmedSQL := strings.TrimSpace(fullSQL)
+
+				// Strip leading SQL comments to find the actual SELECT statement
+				sqlWithoutComments := trimmedSQL
+				for strings.HasPrefix(sqlWithoutComments, "/*") {
+					endComment := strings.Index(sqlWithoutComments, "*/")
+					if endComment == -1 {
+						break
+					}
+					sqlWithoutComments = strings.TrimSpace(sqlWithoutComments[endComment+2:])
 				}
-				sqlWithoutComments = strings.TrimSpace(sqlWithoutComments[endComment+2:])
-			}
 
-			// Record all queries (SELECT, INSERT, UPDATE, DELETE)
-			// Note: Subqueries will be filtered out in post-processing by filterSubqueries()
-			if len(sqlWithoutComments) > 0 {
-				p.queryManager.AddQuery(fullSQL)
+				// Record all queries (SELECT, INSERT, UPDATE, DELETE)
+				// Note: Subqueries will be filtered out in post-processing by filterSubqueries()
+				if len(sqlWithoutComments) > 0 {
+					event := common.QueryEvent{
+						SQL:          fullSQL,
+						RawSQL:       sql,
+						Vars:         vars,
+						Operation:    op,
+						Table:        db.Statement.Table,
+						RowsAffected: db.RowsAffected,
+						Error:        db.Error,
+						Caller:       common.FindCaller(),
+					}
+					if started, ok := db.InstanceGet(p.startTimeKey()); ok {
+						if startedAt, ok := started.(time.Time); ok {
+							event.Duration = time.Since(startedAt)
+						}
+					}
+					p.recorderLocked(db).AddEvent(event)
+				}
 			}
 		}
 	}
 
 	// Register callbacks for all query operations
 	// Note: We record ALL queries here, and filter out subqueries later in post-processing
-	callback.Query().After("gorm:query").Register(fmt.Sprintf("%s:after_query", p.instanceID), afterCallbackFunc)
-	callback.Create().After("gorm:create").Register(fmt.Sprintf("%s:after_create", p.instanceID), afterCallbackFunc)
-	callback.Update().After("gorm:update").Register(fmt.Sprintf("%s:after_update", p.instanceID), afterCallbackFunc)
-	callback.Delete().After("gorm:delete").Register(fmt.Sprintf("%s:after_delete", p.instanceID), afterCallbackFunc)
-	callback.Raw().After("gorm:raw").Register(fmt.Sprintf("%s:after_raw", p.instanceID), afterCallbackFunc)
-	callback.Row().After("gorm:row").Register(fmt.Sprintf("%s:after_row", p.instanceID), afterCallbackFunc)
+	callback.Query().Before("gorm:query").Register(fmt.Sprintf("%s:before_query", p.instanceID), beforeCallbackFunc)
+	callback.Create().Before("gorm:create").Register(fmt.Sprintf("%s:before_create", p.instanceID), beforeCallbackFunc)
+	callback.Update().Before("gorm:update").Register(fmt.Sprintf("%s:before_update", p.instanceID), beforeCallbackFunc)
+	callback.Delete().Before("gorm:delete").Register(fmt.Sprintf("%s:before_delete", p.instanceID), beforeCallbackFunc)
+	callback.Raw().Before("gorm:raw").Register(fmt.Sprintf("%s:before_raw", p.instanceID), beforeCallbackFunc)
+	callback.Row().Before("gorm:row").Register(fmt.Sprintf("%s:before_row", p.instanceID), beforeCallbackFunc)
+
+	callback.Query().After("gorm:query").Register(fmt.Sprintf("%s:after_query", p.instanceID), afterCallbackFunc(common.OperationQuery))
+	callback.Create().After("gorm:create").Register(fmt.Sprintf("%s:after_create", p.instanceID), afterCallbackFunc(common.OperationCreate))
+	callback.Update().After("gorm:update").Register(fmt.Sprintf("%s:after_update", p.instanceID), afterCallbackFunc(common.OperationUpdate))
+	callback.Delete().After("gorm:delete").Register(fmt.Sprintf("%s:after_delete", p.instanceID), afterCallbackFunc(common.OperationDelete))
+	callback.Raw().After("gorm:raw").Register(fmt.Sprintf("%s:after_raw", p.instanceID), afterCallbackFunc(common.OperationRaw))
+	callback.Row().After("gorm:row").Register(fmt.Sprintf("%s:after_row", p.instanceID), afterCallbackFunc(common.OperationRow))
+
+	return nil
+}
+
+// Detach removes the plugin's callbacks from db, so a shared *gorm.DB does not
+// keep accumulating callbacks from every test that used it. It fails when the
+// plugin was not registered on db with db.Use.
+// Recorded queries are kept until Close is called. Detach changes the callbacks
+// and plugins of db without synchronization, so it is not safe to run while
+// queries are issued on db or on sessions derived from it.
+func (p *Plugin) Detach(db *gorm.DB) error {
+	p.mu.Lock()
+	registered := false
+	for i, attached := range p.dbs {
+		if attached == db {
+			p.dbs = append(p.dbs[:i], p.dbs[i+1:]...)
+			registered = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("gormgolden: plugin %s is not registered on this database", p.Name())
+	}
 
+	// GORM logs the removal of each callback as a warning, which is noise in every test cleanup
+	log := db.Config.Logger
+	db.Config.Logger = logger.Discard
+	defer func() { db.Config.Logger = log }()
+
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Query().Remove(fmt.Sprintf("%s:before_query", p.instanceID)),
+		callback.Create().Remove(fmt.Sprintf("%s:before_create", p.instanceID)),
+		callback.Update().Remove(fmt.Sprintf("%s:before_update", p.instanceID)),
+		callback.Delete().Remove(fmt.Sprintf("%s:before_delete", p.instanceID)),
+		callback.Raw().Remove(fmt.Sprintf("%s:before_raw", p.instanceID)),
+		callback.Row().Remove(fmt.Sprintf("%s:before_row", p.instanceID)),
+		callback.Query().Remove(fmt.Sprintf("%s:after_query", p.instanceID)),
+		callback.Create().Remove(fmt.Sprintf("%s:after_create", p.instanceID)),
+		callback.Update().Remove(fmt.Sprintf("%s:after_update", p.instanceID)),
+		callback.Delete().Remove(fmt.Sprintf("%s:after_delete", p.instanceID)),
+		callback.Raw().Remove(fmt.Sprintf("%s:after_raw", p.instanceID)),
+		callback.Row().Remove(fmt.Sprintf("%s:after_row", p.instanceID)),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	// Let the plugin be registered again with db.Use
+	delete(db.Config.Plugins, p.Name())
+	return nil
+}
+
+// Close detaches the plugin from every database it was registered on and
+// releases its QueryManager. The plugin records nothing after Close.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	dbs := append([]*gorm.DB(nil), p.dbs...)
+	p.mu.Unlock()
+
+	for _, db := range dbs {
+		if err := p.Detach(db); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.queryManager = nil
+	p.recorders = nil
+	p.mu.Unlock()
 	return nil
 }
 
+// CloseOnCleanup closes the plugin when the test and all its subtests complete
+func (p *Plugin) CloseOnCleanup(t testing.TB) {
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("gormgolden: failed to close plugin: %v", err)
+		}
+	})
+}
+
+// manager returns the plugin's QueryManager, or nil once the plugin is closed
+func (p *Plugin) manager() *common.QueryManager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queryManager
+}
+
+// startTimeKey is the statement instance key holding the time a statement started
+func (p *Plugin) startTimeKey() string {
+	return p.instanceID + ":started_at"
+}
+
 func buildFullSQL(db *gorm.DB) string {
 	if db.Statement == nil || db.Dialector == nil {
 		return ""
@@ -115,48 +330,133 @@ func buildFullSQLWithVars(dialector gorm.Dialector, sql string, vars []interface
 }
 
 // Local methods on Plugin for managing queries
+// Enable enables query recording, including recorders selected with WithRecorder
 func (p *Plugin) Enable() {
-	if p.queryManager != nil {
-		p.queryManager.Enable()
+	if qm := p.manager(); qm != nil {
+		qm.Enable()
+	}
+	for _, recorder := range p.recorderList() {
+		recorder.Enable()
 	}
 }
 
+// Disable disables query recording, including recorders selected with WithRecorder
 func (p *Plugin) Disable() {
-	if p.queryManager != nil {
-		p.queryManager.Disable()
+	if qm := p.manager(); qm != nil {
+		qm.Disable()
+	}
+	for _, recorder := range p.recorderList() {
+		recorder.Disable()
 	}
 }
 
 func (p *Plugin) Clear() {
-	if p.queryManager != nil {
-		p.queryManager.Clear()
+	if qm := p.manager(); qm != nil {
+		qm.Clear()
+	}
+}
+
+// Step starts a named section of the recording, written to golden files as a "-- step: name" header
+func (p *Plugin) Step(name string) {
+	if qm := p.manager(); qm != nil {
+		qm.Step(name)
 	}
 }
 
 func (p *Plugin) GetQueries() []string {
-	if p.queryManager != nil {
-		return p.queryManager.GetQueries()
+	if qm := p.manager(); qm != nil {
+		return qm.GetQueries()
 	}
 	return []string{}
 }
 
+// GetEvents returns the recorded queries together with their metadata
+func (p *Plugin) GetEvents() []common.QueryEvent {
+	if qm := p.manager(); qm != nil {
+		return qm.GetEvents()
+	}
+	return []common.QueryEvent{}
+}
+
 func (p *Plugin) SaveToFile(filePath string) error {
-	if p.queryManager != nil {
-		return p.queryManager.SaveToFile(filePath)
+	if qm := p.manager(); qm != nil {
+		return qm.SaveToFile(filePath)
 	}
 	return nil
 }
 
-func (p *Plugin) AssertGolden(t *testing.T) {
-	if p.queryManager != nil {
-		p.queryManager.AssertGolden(t)
+func (p *Plugin) AssertGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertGolden(t, opts...)
 	}
 }
 
 // AssertGoldenSorted asserts the recorded queries against a golden file, ignoring query order.
 // This is useful when queries are executed in parallel and their order is non-deterministic.
-func (p *Plugin) AssertGoldenSorted(t *testing.T) {
-	if p.queryManager != nil {
-		p.queryManager.AssertGoldenSorted(t)
+func (p *Plugin) AssertGoldenSorted(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertGoldenSorted(t, opts...)
+	}
+}
+
+// AssertContainsGolden asserts that the golden file's queries were recorded in order,
+// ignoring other queries recorded before, between and after them
+func (p *Plugin) AssertContainsGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertContainsGolden(t, opts...)
+	}
+}
+
+// AssertSubsetGolden asserts that every query of the golden file was recorded, in any order
+func (p *Plugin) AssertSubsetGolden(t testing.TB, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertSubsetGolden(t, opts...)
+	}
+}
+
+// AssertEquivalentTo asserts that the recorded queries are equivalent to a golden file recorded
+// by gormgoldenv1, tolerating the known differences between GORM v1 and v2 queries
+func (p *Plugin) AssertEquivalentTo(t testing.TB, v1GoldenPath string) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertEquivalentTo(t, v1GoldenPath)
+	}
+}
+
+// AssertNoNPlusOne fails the test if a SELECT shape, ignoring literal values, was recorded
+// more than threshold times, reporting the call sites that issued it.
+// Pass common.IncludeWrites() to check INSERT, UPDATE and DELETE statements too.
+func (p *Plugin) AssertNoNPlusOne(t testing.TB, threshold int, opts ...common.AssertOption) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertNoNPlusOne(t, threshold, opts...)
+	}
+}
+
+// AssertQueryCount fails the test unless exactly n queries were recorded
+func (p *Plugin) AssertQueryCount(t testing.TB, n int) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertQueryCount(t, n)
+	}
+}
+
+// AssertMaxQueries fails the test if more than n queries were recorded
+func (p *Plugin) AssertMaxQueries(t testing.TB, n int) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertMaxQueries(t, n)
+	}
+}
+
+// AssertBudget fails the test if the recorded queries exceed the budget per statement type or table
+func (p *Plugin) AssertBudget(t testing.TB, budget common.Budget) {
+	t.Helper()
+	if qm := p.manager(); qm != nil {
+		qm.AssertBudget(t, budget)
 	}
 }
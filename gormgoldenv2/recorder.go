@@ -0,0 +1,75 @@
+package gormgoldenv2
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/po3rin/gormgolden/common"
+	"gorm.io/gorm"
+)
+
+// recorderKey is the context key holding the recorder name set by WithRecorder
+type recorderKey struct{}
+
+// WithRecorder returns a copy of ctx that routes queries issued with it to the recorder
+// named name instead of the plugin's own recording. Parallel subtests sharing one *gorm.DB
+// can each use their own recorder so their golden files do not mix:
+//
+//	tx := db.WithContext(gormgoldenv2.WithRecorder(ctx, t.Name()))
+//	...
+//	plugin.Recorder(t.Name()).AssertGolden(t)
+func WithRecorder(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, recorderKey{}, name)
+}
+
+// Recorder returns the QueryManager recording queries issued with WithRecorder(ctx, name).
+// Its golden file is <name>.golden.sql next to the plugin's golden file, with subtest
+// slashes replaced by "__". Recorder returns nil once the plugin is closed.
+func (p *Plugin) Recorder(name string) *common.QueryManager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.namedRecorderLocked(name)
+}
+
+// recorderLocked returns the QueryManager a statement should be recorded by. p.mu must be held.
+func (p *Plugin) recorderLocked(db *gorm.DB) *common.QueryManager {
+	if db.Statement.Context != nil {
+		if name, ok := db.Statement.Context.Value(recorderKey{}).(string); ok {
+			return p.namedRecorderLocked(name)
+		}
+	}
+	return p.queryManager
+}
+
+// namedRecorderLocked returns the recorder for name, creating it on first use. p.mu must be held.
+func (p *Plugin) namedRecorderLocked(name string) *common.QueryManager {
+	if p.queryManager == nil {
+		return nil
+	}
+	if recorder, ok := p.recorders[name]; ok {
+		return recorder
+	}
+
+	if p.recorders == nil {
+		p.recorders = map[string]*common.QueryManager{}
+	}
+	goldenFile := filepath.Join(filepath.Dir(p.GoldenFile), goldenFileName(name))
+	recorder := common.NewQueryManager(goldenFile, p.managerOptions...)
+	recorder.SetDialect(p.queryManager.Dialect())
+	if !p.queryManager.Enabled() {
+		recorder.Disable()
+	}
+	p.recorders[name] = recorder
+	return recorder
+}
+
+// recorderList returns a snapshot of the recorders created so far
+func (p *Plugin) recorderList() []*common.QueryManager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recorders := make([]*common.QueryManager, 0, len(p.recorders))
+	for _, recorder := range p.recorders {
+		recorders = append(recorders, recorder)
+	}
+	return recorders
+}
@@ -0,0 +1,68 @@
+package gormgoldenv2
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// scopeKey is the context key marking statements issued through a ForTest session.
+// Its value is the instance ID of the plugin that should record them.
+type scopeKey struct{}
+
+// ForTest registers a plugin scoped to a single test. It returns a session of db
+// whose queries are recorded, and the plugin recording them. Queries issued through
+// db itself or through other sessions are ignored.
+//
+// The golden file is testdata/<test name>.golden.sql, with subtest slashes replaced by "__".
+// When the test completes the recorded queries are asserted against it and the plugin is closed.
+// ForTest works with *testing.T, *testing.B and *testing.F.
+func ForTest(t testing.TB, db *gorm.DB, opts ...Option) (*gorm.DB, *Plugin) {
+	t.Helper()
+
+	p := New(filepath.Join("testdata", goldenFileName(t.Name())), opts...)
+	p.scoped = true
+	if err := db.Use(p); err != nil {
+		t.Fatalf("gormgolden: failed to register plugin: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if !t.Skipped() {
+			p.AssertGolden(t)
+		}
+		if err := p.Close(); err != nil {
+			t.Errorf("gormgolden: failed to close plugin: %v", err)
+		}
+	})
+
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return db.WithContext(context.WithValue(ctx, scopeKey{}, p.instanceID)), p
+}
+
+// inScope reports whether a statement should be recorded by p
+func (p *Plugin) inScope(db *gorm.DB) bool {
+	if !p.scoped {
+		return true
+	}
+	if db.Statement.Context == nil {
+		return false
+	}
+	id, _ := db.Statement.Context.Value(scopeKey{}).(string)
+	return id == p.instanceID
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// goldenFileName derives a golden file name from a test name such as "TestUser/create_admin"
+func goldenFileName(name string) string {
+	name = strings.ReplaceAll(name, "/", "__")
+	name = unsafeFileNameChars.ReplaceAllString(name, "_")
+	return name + ".golden.sql"
+}
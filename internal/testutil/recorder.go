@@ -0,0 +1,33 @@
+// Package testutil holds helpers shared by the gormgolden tests
+package testutil
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// FailureRecorder captures the failures and logs reported by an assertion expected to fail,
+// forwarding everything else to the wrapped testing.TB
+type FailureRecorder struct {
+	testing.TB
+	Failures []string
+	Logs     []string
+}
+
+// Errorf records a failure instead of failing the test
+func (r *FailureRecorder) Errorf(format string, args ...interface{}) {
+	r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+}
+
+// Log records a log line instead of writing it to the test output
+func (r *FailureRecorder) Log(args ...interface{}) {
+	r.Logs = append(r.Logs, fmt.Sprint(args...))
+}
+
+// Fatalf records a failure and stops the calling goroutine. Assertions that can call it must
+// run in a goroutine of their own, as the test fails when its goroutine stops this way.
+func (r *FailureRecorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
@@ -19,12 +19,12 @@ func main() {
 	fmt.Println("GORM v1:", gormv1Query)
 	fmt.Println("GORM v2:", gormv2Query)
 
-	// Debug WHERE clause processing
-	fmt.Println("\n=== GORM v1 WHERE Debug ===")
-	qm.DebugWhereClause(gormv1Query)
+	// Trace each normalization stage
+	fmt.Println("\n=== GORM v1 Normalization Trace ===")
+	printTrace(qm, gormv1Query)
 
-	fmt.Println("\n=== GORM v2 WHERE Debug ===")
-	qm.DebugWhereClause(gormv2Query)
+	fmt.Println("\n=== GORM v2 Normalization Trace ===")
+	printTrace(qm, gormv2Query)
 
 	// 正規化してテスト
 	fmt.Println("\n=== Comparison Result ===")
@@ -53,3 +53,11 @@ func main() {
 		}
 	}
 }
+
+func printTrace(qm *common.QueryManager, query string) {
+	for _, stage := range qm.NormalizeTrace(query) {
+		if stage.Changed() {
+			fmt.Printf("%s: %s\n", stage.Name, stage.After)
+		}
+	}
+}